@@ -25,17 +25,27 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
 	"time"
+
+	"golang.org/x/net/proxy"
 )
 
 /*
 Arbiter provides a command and control interface to []byte streams. Original design intentions
 were to provide a way to communicate to devices that respond to 'commands' sent over the wire. Functionally,
 this can be seen as a socket or generic IO wrapper to provide a way to read and write commands and data.
-As a sanity, there can only be one caller, as this is purposefully not safe from mutliple callers via the
-standard "go <func>" syntax.  Any errors that are not ErrTimeout or ErrBusy are errors coming from the
-underlying layers and are to be delt with
+Commands are handled one at a time; concurrent callers are serialized and wait their turn.  Any errors
+that are not ErrTimeout or ErrBusy are errors coming from the underlying layers and are to be delt with.
+
+Arbiter itself stays small.  Anything more an implementation offers is grouped into the Controller,
+Configurer, Governor and Monitor interfaces, which callers type assert for, and which every Arbiter
+returned by this package implements
 */
 type Arbiter interface {
 	//Close and free any resources in use.
@@ -52,15 +62,306 @@ type Arbiter interface {
 	Control(cmd Command, args ...interface{}) Response
 }
 
+/*Controller is implemented by Arbiters offering more ways to issue a command than Control.  Type assert
+an Arbiter to it to use them*/
+type Controller interface {
+	//ControlContext is Control bounded by ctx as well.  Whichever of ctx and cmd.Timeout runs out first
+	//wins: ErrTimeout is returned for cmd.Timeout, and ctx.Err() for ctx
+	ControlContext(ctx context.Context, cmd Command, args ...interface{}) Response
+
+	//ControlDeadline is Control with an absolute deadline for the reply in place of cmd.Timeout
+	ControlDeadline(cmd Command, deadline time.Time, args ...interface{}) Response
+
+	//ControlID is Control with a correlation ID for logging, handed back in Response.ID
+	ControlID(id string, cmd Command, args ...interface{}) Response
+
+	//ControlAsync queues cmd and returns immediately, calling cb with the Response once it completes.  Async
+	//commands run in the order queued, and cb is called from a goroutine of the Arbiter's, never the caller's
+	ControlAsync(cmd Command, cb func(Response), args ...interface{})
+
+	//ControlProgress is Control that also hands onChunk each piece of the reply as it arrives, for progress
+	//reports ahead of the final Response
+	ControlProgress(cmd Command, onChunk func([]byte), args ...interface{}) Response
+
+	//TryControl is like Control, but if the Arbiter is busy with another command it returns immediately
+	//with a zero Response and false rather than waiting.  Otherwise it returns Control's Response and true
+	TryControl(cmd Command, args ...interface{}) (Response, bool)
+}
+
+/*Configurer is implemented by Arbiters whose connection setup and wire handling can be tuned.  Settings
+generally take effect from the next Dial or command*/
+type Configurer interface {
+	//DialWithResult is Dial, also reporting the peer's address, the pings issued, and their round trip time
+	DialWithResult(addr string, timeout time.Duration, pingCmd Command) (DialResult, error)
+
+	//SetWarmup sets commands issued by Dial once the connection has answered its pings, before the
+	//SetOnConnect func.  Dial fails with ErrSetupFailed if any fails
+	SetWarmup(cmds []Command)
+
+	//SetOnConnect sets a function run by Dial once the connection has answered its pings, typically to
+	//log in.  If it returns an error, Dial fails with ErrSetupFailed
+	SetOnConnect(fn func(a Arbiter) error)
+
+	//SetPreamble has b sent immediately before every command, such as a wakeup sequence.  Empty sends nothing
+	SetPreamble(b []byte)
+
+	//SetWireCodec transforms all outgoing request bytes with enc and all incoming bytes with dec, so Commands
+	//work in decoded bytes over an encoded wire.  nil for either means no transform
+	SetWireCodec(enc, dec func([]byte) []byte)
+
+	//SetMaxLifetime closes the connection d after each subsequent successful Dial, regardless of activity.
+	//d <= 0 means no limit
+	SetMaxLifetime(d time.Duration)
+
+	//SetExpectProxyHeader has Dial read a PROXY protocol v1 header off the connection before the ping, for
+	//devices behind HAProxy style front ends.  Its address is then what RemoteAddr returns
+	SetExpectProxyHeader(expect bool)
+
+	//RemoteAddr returns the address of the peer, nil before the first Dial
+	RemoteAddr() net.Addr
+
+	//SetNoDelay enables (the default) or disables TCP_NODELAY for subsequent Dials.  It is a no-op for
+	//transports where it does not apply
+	SetNoDelay(noDelay bool)
+
+	//SetInterByteDelay has requests written a byte at a time d apart, for devices that drop characters sent
+	//back to back.  d <= 0, the default, sends each request in a single write
+	SetInterByteDelay(d time.Duration)
+
+	//SetFallbackDelay sets how long a dual stack Dial waits on the preferred address family before racing the
+	//other one as well, Happy Eyeballs style.  0 is Go's default of 300ms, and d < 0 disables the race
+	SetFallbackDelay(d time.Duration)
+}
+
+//Governor is implemented by Arbiters that can limit, hold back, or drain the commands given to them
+type Governor interface {
+	//CloseGraceful rejects new commands with ErrClosing, lets those already queued finish, bounded by
+	//timeout, then closes as Close does
+	CloseGraceful(timeout time.Duration) error
+
+	//SetMaxQueue limits how many Control calls and ControlAsync commands may wait behind the command in
+	//flight, after which they fail with ErrQueueFull.  n <= 0 means no limit
+	SetMaxQueue(n int)
+
+	//QueueLen returns the number of Control calls and ControlAsync commands waiting behind the command in flight
+	QueueLen() int
+
+	//WaitIdle blocks until no command is in flight, returning ErrTimeout if that takes longer than timeout
+	WaitIdle(timeout time.Duration) error
+
+	//SetCircuitBreaker makes commands fail fast with ErrCircuitOpen once failures in a row have failed, until
+	//cooldown passes and a trial command succeeds.  failures <= 0 turns it off
+	SetCircuitBreaker(failures int, cooldown time.Duration)
+
+	//CacheClear drops every Response cached for Command.CacheTTL
+	CacheClear()
+
+	//SetDryRun makes Control only form and validate commands, returning the formed bytes in Response.Sent
+	//without writing anything to the wire, so scripts can be checked offline
+	SetDryRun(on bool)
+
+	//Pause makes Control return ErrPaused for new commands while keeping the connection open.  In-flight
+	//commands are allowed to complete
+	Pause()
+
+	//Resume undoes Pause
+	Resume()
+}
+
+//Monitor is implemented by Arbiters that report on their connection and traffic without issuing commands
+type Monitor interface {
+	//Done returns a channel closed once the current connection is finished with, whether by Close, a
+	//transport error, or SetMaxLifetime
+	Done() <-chan struct{}
+
+	//LastError returns the error that broke the connection, without issuing a command.  It is nil while the
+	//connection is healthy
+	LastError() error
+
+	//StalledFor returns how long the command in flight has gone without receiving anything, 0 if there is none
+	StalledFor() time.Duration
+
+	//Snapshot returns the Arbiter's connection state, last error, uptime, and counters in one go, in a
+	//form that marshals to JSON for admin endpoints
+	Snapshot() Snapshot
+
+	//BytesRead and BytesWritten return the bytes read off and written to the wire over the Arbiter's whole
+	//life, pings and unsolicited data included.  They are kept across reconnects
+	BytesRead() uint64
+	BytesWritten() uint64
+
+	//SetStateObserver has fn called with every internal state transition, such as StateIdle to
+	//StateWaitingOnReply, for debugging.  nil removes it
+	SetStateObserver(fn func(from, to int))
+
+	//Probe sends the ping command that was given to Dial, and returns its round trip time and any error
+	Probe() (time.Duration, error)
+
+	//Tap mirrors all raw traffic, in both directions, to w with a small direction and timestamp header
+	//per chunk, until Untap is called.  What a slow w cannot keep up with is dropped, and counted in w
+	Tap(w io.Writer)
+
+	//Untap stops a Tap, returning once everything tapped so far has been written
+	Untap()
+
+	//SetTranscript keeps the last max bytes of traffic since Dial, both ways, for Transcript.  max <= 0 turns
+	//it off
+	SetTranscript(max int)
+
+	//Transcript returns the traffic kept since SetTranscript, in the same format as Tap
+	Transcript() []byte
+
+	//Capabilities describes what the underlying transport supports
+	Capabilities() Capabilities
+}
+
+//Capabilities is a bitset describing what an Arbiter's transport supports, see Monitor.Capabilities
+type Capabilities uint32
+
+//The Capabilities an Arbiter may report
+const (
+	CapHalfDuplex   Capabilities = 1 << iota //one command at a time, each request followed by its reply
+	CapEOFDetection                          //notices the peer closing, see Done and LastError
+	CapNoDelay                               //SetNoDelay has an effect
+)
+
+//Has reports if all of the capabilities in c are present
+func (caps Capabilities) Has(c Capabilities) bool {
+	return caps&c == c
+}
+
 /*New returns a Arbiter for the requested type.  Currently, only "tcp" or "tcp4" types are implemented
 and requesting anything other than "tcp" or "tcp4" will panic*/
 func New(Type string) Arbiter {
 	var rtn Arbiter
 	switch Type {
 	case "tcp", "tcp4":
-		rtn = new(tcp)
+		rtn = NewNet(Type)
 	default:
 		panic(fmt.Errorf("Unable to create an Arbiter of type %q", Type))
 	}
 	return rtn
 }
+
+/*NewNet returns an Arbiter that Dials over network, which is handed straight to net.Dialer.  Any
+stream network works, such as "tcp", "tcp4", "tcp6", "unix" or "unixpacket", and all share the one
+implementation.  An unknown network is only reported when Dial fails with ErrConnectFailed*/
+func NewNet(network string) Arbiter {
+	t := &tcp{network: network}
+	t.channels()
+	return t
+}
+
+/*NewVia returns a tcp Arbiter that connects to its Dial address through the SOCKS5 proxy at proxyAddr,
+which is something like "bastion.tld:1080".  Everything past connecting, including the ping verification,
+is identical to an Arbiter returned from New("tcp")*/
+func NewVia(proxyAddr string) Arbiter {
+	t := &tcp{dialer: func(addr string, timeout time.Duration) (net.Conn, error) {
+		d, err := proxy.SOCKS5("tcp", proxyAddr, nil, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}}
+	t.channels()
+	return t
+}
+
+/*NewConn returns a tcp Arbiter that runs over conn, an already established connection such as one end of
+a net.Pipe or a connection upgraded with STARTTLS.  Dial must still be called to start it up and verify the
+ping, but its addr is ignored.  Close closes conn, and as conn cannot be reopened, any later Dial fails*/
+func NewConn(conn net.Conn) Arbiter {
+	var used atomic.Bool
+	t := &tcp{dialer: func(string, time.Duration) (net.Conn, error) {
+		if used.Swap(true) { //concurrent Dials must not both get conn
+			return nil, net.ErrClosed
+		}
+		return conn, nil
+	}}
+	t.channels()
+	return t
+}
+
+/*Once is a convenience wrapper for one-shot use.  It creates an Arbiter of Type (panicing like New
+for unknown types), Dials addr, issues a single cmd with args, and Closes the Arbiter.  Close is always
+called, even if Dial or the command fails.  The returned error is the first of the Dial error, the
+command's Response.Error, or the Close error*/
+func Once(Type, addr string, timeout time.Duration, pingCmd, cmd Command, args ...interface{}) (resp Response, err error) {
+	a := New(Type)
+	defer func() {
+		if cerr := a.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if err = a.Dial(addr, timeout, pingCmd); err != nil {
+		return Response{Error: err}, err
+	}
+	resp = a.Control(cmd, args...)
+	return resp, resp.Error
+}
+
+/*ControlStable issues cmd with args on a over and over until need consecutive Responses have identical
+Bytes, filtering out transient readings, and returns the last of them.  It gives up after max attempts
+with ErrUnstable, along with the last Response.  Any failed command ends it straight away, returning that
+Response and its error*/
+func ControlStable(a Arbiter, cmd Command, need, max int, args ...interface{}) (Response, error) {
+	var last Response
+	for n, streak := 0, 0; n < max; n++ {
+		resp := a.Control(cmd, args...)
+		if resp.Error != nil {
+			return resp, resp.Error
+		}
+		if streak > 0 && bytes.Equal(resp.Bytes, last.Bytes) {
+			streak++
+		} else {
+			streak = 1
+		}
+		last = resp
+		last.Bytes = append([]byte(nil), resp.Bytes...) //dont alias the Arbiter's buffer
+		if streak >= need {
+			return last, nil
+		}
+	}
+	return last, ErrUnstable
+}
+
+/*ControlExpect issues cmd with args on a and checks the reply is exactly want, for assertion style checks
+such as "send X, the reply must be OK".  Set cmd.TrimResponse to ignore a line terminator.  It returns the
+command's error if it failed, an error wrapping ErrUnexpected showing what came back if that was not want,
+and otherwise nil*/
+func ControlExpect(a Arbiter, cmd Command, want []byte, args ...interface{}) error {
+	resp := a.Control(cmd, args...)
+	if resp.Error != nil {
+		return resp.Error
+	}
+	if !bytes.Equal(resp.Bytes, want) {
+		return fmt.Errorf("%w: %s got %q, want %q", ErrUnexpected, cmd.Name, resp.Bytes, want)
+	}
+	return nil
+}
+
+/*PollUntil issues cmd with args on a every interval until pred accepts the Response, such as waiting for a
+temperature to fall, and returns that Response.  interval is counted from the start of one command to the
+start of the next, so slow commands do not stretch it.  If timeout passes first it gives up with ErrTimeout,
+along with the last Response.  Any failed command ends it straight away, returning that Response and its
+error*/
+func PollUntil(a Arbiter, cmd Command, pred func(Response) bool, interval, timeout time.Duration, args ...interface{}) (Response, error) {
+	end := time.Now().Add(timeout)
+	for {
+		start := time.Now()
+		resp := a.Control(cmd, args...)
+		if resp.Error != nil {
+			return resp, resp.Error
+		}
+		if pred(resp) {
+			return resp, nil
+		}
+		next := start.Add(interval)
+		if !next.Before(end) {
+			return resp, ErrTimeout
+		}
+		time.Sleep(time.Until(next))
+	}
+}
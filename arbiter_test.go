@@ -25,7 +25,18 @@ SOFTWARE.
 */
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_New(t *testing.T) {
@@ -56,3 +67,236 @@ func Test_New(t *testing.T) {
 		t.Fatalf("Type is not of type tcp")
 	}
 }
+
+func TestOnce(t *testing.T) {
+	resp, err := Once("tcp", dial, 100*time.Millisecond, pingOk, pingOk)
+	if err != nil || string(resp.Bytes) != "\r" {
+		t.Fatalf("Once should succeed with a good command: %v %v", resp, err)
+	}
+
+	if _, err := Once("tcp", dial, 100*time.Millisecond, pingOk, pingBad); err != ErrTimeout {
+		t.Fatalf("Once should return the command error: %v", err)
+	}
+
+	if _, err := Once("tcp", "host-does-not-exist:65537", 100*time.Millisecond, pingOk, pingOk); err == nil {
+		t.Fatalf("Once should fail when unable to dial")
+	}
+}
+
+func TestNew_Interfaces(t *testing.T) {
+	for _, a := range []Arbiter{New("tcp"), NewNet("unix"), NewVia(dial), NewConn(nil)} {
+		if _, ok := a.(Controller); !ok {
+			t.Errorf("%T should implement Controller", a)
+		}
+		if _, ok := a.(Configurer); !ok {
+			t.Errorf("%T should implement Configurer", a)
+		}
+		if _, ok := a.(Governor); !ok {
+			t.Errorf("%T should implement Governor", a)
+		}
+		if _, ok := a.(Monitor); !ok {
+			t.Errorf("%T should implement Monitor", a)
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	caps := New("tcp").(Monitor).Capabilities()
+	if !caps.Has(CapHalfDuplex) || !caps.Has(CapEOFDetection|CapNoDelay) {
+		t.Fatalf("tcp should report its capabilities: %b", caps)
+	}
+	if NewNet("unix").(Monitor).Capabilities().Has(CapNoDelay) {
+		t.Fatalf("unix sockets have no TCP_NODELAY")
+	}
+	if Capabilities(0).Has(CapNoDelay) || CapNoDelay.Has(CapNoDelay|CapHalfDuplex) {
+		t.Fatalf("Has should require every capability")
+	}
+}
+
+func TestControlStable(t *testing.T) {
+	readings := func(vals ...string) func(net.Conn) {
+		return func(conn net.Conn) {
+			buf := make([]byte, 64)
+			for _, v := range vals {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				conn.Write([]byte(v + "\r"))
+			}
+		}
+	}
+	read := Command{
+		Name:          "read",
+		Timeout:       50 * time.Millisecond,
+		Prototype:     "READ\r",
+		CommandRegexp: regexp.MustCompile("READ\r"),
+		Response:      regexp.MustCompile(`[0-9.]+\r`),
+	}
+
+	tc := pipeTcp(t, readings("1.0", "1.2", "1.1", "1.1", "1.2", "1.2", "1.2", "9.9"))
+	resp, err := ControlStable(tc, read, 3, 10)
+	if err != nil || string(resp.Bytes) != "1.2\r" {
+		t.Fatalf("Should settle on three identical readings: %v %v", resp, err)
+	}
+	tc.Close()
+
+	tc = pipeTcp(t, readings("1.0", "1.1", "1.0", "1.1"))
+	if resp, err = ControlStable(tc, read, 2, 4); err != ErrUnstable || string(resp.Bytes) != "1.1\r" {
+		t.Fatalf("Should give up after max attempts: %v %v", resp, err)
+	}
+	if resp, err = ControlStable(tc, read, 2, 4); !errors.Is(err, ErrTransport) || err != resp.Error { //device hung up
+		t.Fatalf("A failed command should end it: %v %v", resp, err)
+	}
+	tc.Close()
+}
+
+func TestNewConn(t *testing.T) {
+	client, server := net.Pipe()
+	go func() { //echo
+		buf := make([]byte, 64)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			server.Write(buf[:n])
+		}
+	}()
+	a := NewConn(client)
+	if e := a.Dial("ignored", 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Should Dial over the provided conn: %v", e)
+	}
+	if resp := a.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Should work over the provided conn: %v", resp)
+	}
+	a.Close()
+	if _, err := server.Write([]byte("x")); err == nil {
+		t.Fatalf("Close should close the provided conn")
+	}
+	if e := a.Dial("ignored", 100*time.Millisecond, pingOk); !errors.Is(e, ErrConnectFailed) {
+		t.Fatalf("The provided conn cannot be redialed: %v", e)
+	}
+
+	dialer := NewConn(client).(*tcp).dialer
+	var wg sync.WaitGroup
+	var got atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, _ := dialer("ignored", time.Second); conn != nil {
+				got.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got.Load() != 1 {
+		t.Fatalf("Concurrent Dials should hand out the provided conn once, not %d times", got.Load())
+	}
+}
+
+func TestNewNet(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "device.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("No unix sockets here: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go HandleRequest(conn) //same echo as the tcp simulator
+		}
+	}()
+
+	a := NewNet("unix")
+	if e := a.Dial(sock, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Should Dial over a unix socket: %v", e)
+	}
+	if resp := a.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Should work over a unix socket: %v", resp)
+	}
+	a.Close()
+
+	if e := NewNet("carrier-pigeon").Dial(sock, 100*time.Millisecond, pingOk); !errors.Is(e, ErrConnectFailed) {
+		t.Fatalf("Unknown network should fail to Dial: %v", e)
+	}
+	if tc := New("tcp4").(*tcp); tc.network != "tcp4" {
+		t.Fatalf("New should pass the network through: %q", tc.network)
+	}
+}
+
+func TestControlExpect(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for _, reply := range []string{"OK\r\n", "FAIL\r\n"} {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte(reply))
+		}
+		io.Copy(io.Discard, conn) //then goes quiet
+	})
+	defer tc.Close()
+	set := Command{
+		Name:          "set",
+		Timeout:       50 * time.Millisecond,
+		Prototype:     "SET %d\r",
+		CommandRegexp: regexp.MustCompile(`SET \d+\r`),
+		Response:      regexp.MustCompile(`[A-Z]+\r\n`),
+		TrimResponse:  true,
+	}
+	if err := ControlExpect(tc, set, []byte("OK"), 1); err != nil {
+		t.Fatalf("Expected reply should give nil: %v", err)
+	}
+	err := ControlExpect(tc, set, []byte("OK"), 2)
+	if !errors.Is(err, ErrUnexpected) || !strings.Contains(err.Error(), `"FAIL"`) || !strings.Contains(err.Error(), `"OK"`) {
+		t.Fatalf("Unexpected reply should show got and want: %v", err)
+	}
+	if err := ControlExpect(tc, set, []byte("OK"), 3); err != ErrTimeout {
+		t.Fatalf("A failed command should give its error: %v", err)
+	}
+}
+
+func TestPollUntil(t *testing.T) {
+	temp := 35
+	tc := pipeTcp(t, func(conn net.Conn) { //cools a degree per reading
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte(fmt.Sprintf("%d\r", temp)))
+			temp--
+		}
+	})
+	defer tc.Close()
+	read := Command{
+		Name:          "temp",
+		Timeout:       50 * time.Millisecond,
+		Prototype:     "TEMP?\r",
+		CommandRegexp: regexp.MustCompile(`TEMP\?\r`),
+		Response:      regexp.MustCompile(`\d+\r`),
+		TrimResponse:  true,
+	}
+	below := func(limit int) func(Response) bool {
+		return func(r Response) bool {
+			n, _ := strconv.Atoi(string(r.Bytes))
+			return n < limit
+		}
+	}
+	then := time.Now()
+	resp, err := PollUntil(tc, read, below(30), 10*time.Millisecond, time.Second)
+	if err != nil || string(resp.Bytes) != "29" {
+		t.Fatalf("Should poll until the condition holds: %v %v", resp, err)
+	}
+	if took := time.Since(then); took < 60*time.Millisecond {
+		t.Fatalf("Polls should be paced by interval, took %v", took)
+	}
+	if resp, err = PollUntil(tc, read, below(0), 10*time.Millisecond, 35*time.Millisecond); err != ErrTimeout || len(resp.Bytes) == 0 {
+		t.Fatalf("Should give up after timeout with the last Response: %v %v", resp, err)
+	}
+}
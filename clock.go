@@ -0,0 +1,76 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"time"
+)
+
+/*clock is where tcp gets the time from when timing commands, Dials and connection lifetimes.  It is a real
+clock unless swapped out, typically by tests that want to step through timeouts without sleeping*/
+type clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) ticker
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+//timer is the part of a time.Timer that tcp uses
+type timer interface {
+	Stop() bool
+}
+
+//ticker is the part of a time.Ticker that tcp uses
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+//realClock is the default clock, backed by the time package
+type realClock struct{}
+
+//Now returns time.Now()
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+//NewTicker returns a time.Ticker
+func (realClock) NewTicker(d time.Duration) ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+//realTicker adapts a time.Ticker to ticker
+type realTicker struct {
+	*time.Ticker
+}
+
+//C returns the ticker's channel
+func (r realTicker) C() <-chan time.Time {
+	return r.Ticker.C
+}
+
+//AfterFunc returns a time.AfterFunc timer
+func (realClock) AfterFunc(d time.Duration, f func()) timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,145 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+/*Codec frames messages on the wire, for Command.Codec.  Encode wraps an outgoing request in its framing,
+and Decode looks for the first complete frame in the incoming buffer, returning its payload, how many bytes
+of buf it took up (including anything skipped before it), and whether it is complete at all.  Until
+complete, the frame and consumed are ignored and more bytes are awaited.  Implement it for framings not
+built in to the package*/
+type Codec interface {
+	Encode(b []byte) []byte
+	Decode(buf []byte) (frame []byte, consumed int, complete bool)
+}
+
+//LineCodec frames messages as lines ending in Delim, such as "\r\n".  The zero value uses "\n"
+type LineCodec struct {
+	Delim string //line terminator, "\n" if empty
+}
+
+func (l LineCodec) delim() []byte {
+	if l.Delim == "" {
+		return []byte("\n")
+	}
+	return []byte(l.Delim)
+}
+
+//Encode appends Delim to b
+func (l LineCodec) Encode(b []byte) []byte {
+	return append(b[:len(b):len(b)], l.delim()...)
+}
+
+//Decode returns the first line in buf, without Delim
+func (l LineCodec) Decode(buf []byte) ([]byte, int, bool) {
+	i := bytes.Index(buf, l.delim())
+	if i < 0 {
+		return nil, 0, false
+	}
+	return buf[:i], i + len(l.delim()), true
+}
+
+//FrameCodec frames messages as STX payload ETX.  If STX is 0, the payload is everything up to ETX
+type FrameCodec struct {
+	STX, ETX byte
+}
+
+//Encode wraps b in STX and ETX
+func (f FrameCodec) Encode(b []byte) []byte {
+	out := make([]byte, 0, len(b)+2)
+	if f.STX != 0 {
+		out = append(out, f.STX)
+	}
+	return append(append(out, b...), f.ETX)
+}
+
+//Decode returns the payload of the first complete frame in buf.  Anything before STX is skipped
+func (f FrameCodec) Decode(buf []byte) ([]byte, int, bool) {
+	start := 0
+	if f.STX != 0 {
+		if start = bytes.IndexByte(buf, f.STX) + 1; start == 0 {
+			return nil, 0, false
+		}
+	}
+	end := bytes.IndexByte(buf[start:], f.ETX)
+	if end < 0 {
+		return nil, 0, false
+	}
+	return buf[start : start+end], start + end + 1, true
+}
+
+//ErrLengthPrefix is returned for a Command framed by a LengthPrefix whose Size is not 1, 2, 4 or 8
+var ErrLengthPrefix = errors.New("Invalid LengthPrefix Size")
+
+//check reports if Size is one LengthPrefix can handle
+func (l LengthPrefix) check() error {
+	switch l.Size {
+	case 1, 2, 4, 8:
+		return nil
+	}
+	return fmt.Errorf("%w: %d", ErrLengthPrefix, l.Size)
+}
+
+/*Encode puts a header holding len(b) in front of b.  Lengths that do not fit in Size bytes are truncated.
+With an invalid Size, b is returned as is*/
+func (l LengthPrefix) Encode(b []byte) []byte {
+	if l.check() != nil {
+		return b
+	}
+	out := make([]byte, l.Size, l.Size+len(b))
+	for i := range out {
+		shift := uint(8 * (l.Size - 1 - i)) //big-endian
+		if l.LittleEndian {
+			shift = uint(8 * i)
+		}
+		out[i] = byte(uint64(len(b)) >> shift)
+	}
+	return append(out, b...)
+}
+
+//Decode returns the payload after the header at the start of buf, once all of it has arrived.  With an
+//invalid Size it never does, Commands framed by it fail with ErrLengthPrefix instead
+func (l LengthPrefix) Decode(buf []byte) ([]byte, int, bool) {
+	if l.check() != nil || len(buf) < l.Size {
+		return nil, 0, false
+	}
+	n := uint64(0)
+	for i := 0; i < l.Size; i++ {
+		shift := uint(8 * (l.Size - 1 - i)) //big-endian
+		if l.LittleEndian {
+			shift = uint(8 * i)
+		}
+		n |= uint64(buf[i]) << shift
+	}
+	if uint64(len(buf)-l.Size) < n {
+		return nil, 0, false
+	}
+	return buf[l.Size : l.Size+int(n)], l.Size + int(n), true
+}
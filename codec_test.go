@@ -0,0 +1,70 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	tests := []struct {
+		codec    Codec
+		encoded  string
+		consumed int
+	}{
+		{LineCodec{}, "hello\n", 6},
+		{LineCodec{Delim: "\r\n"}, "hello\r\n", 7},
+		{FrameCodec{STX: 0x02, ETX: 0x03}, "\x02hello\x03", 7},
+		{FrameCodec{ETX: 0x03}, "hello\x03", 6},
+		{LengthPrefix{Size: 2}, "\x00\x05hello", 7},
+		{LengthPrefix{Size: 4, LittleEndian: true}, "\x05\x00\x00\x00hello", 9},
+		{LengthPrefix{Size: 8}, "\x00\x00\x00\x00\x00\x00\x00\x05hello", 13},
+	}
+	for i, test := range tests {
+		in := []byte("hello")
+		if enc := test.codec.Encode(in); string(enc) != test.encoded || string(in) != "hello" {
+			t.Errorf("%d: Encode should give %q, got %q (input now %q)", i, test.encoded, enc, in)
+		}
+		frame, n, ok := test.codec.Decode([]byte(test.encoded + "next"))
+		if !ok || string(frame) != "hello" || n != test.consumed {
+			t.Errorf("%d: Decode should give hello, %d; got %q, %d, %v", i, test.consumed, frame, n, ok)
+		}
+		if _, _, ok := test.codec.Decode([]byte(test.encoded[:len(test.encoded)-1])); ok {
+			t.Errorf("%d: A partial frame should not be complete", i)
+		}
+	}
+	if frame, n, ok := (FrameCodec{STX: 0x02, ETX: 0x03}).Decode([]byte("junk\x02ok\x03")); !ok || !bytes.Equal(frame, []byte("ok")) || n != 8 {
+		t.Errorf("Bytes before STX should be skipped and counted as consumed: %q %d %v", frame, n, ok)
+	}
+	for _, l := range []LengthPrefix{{}, {Size: 3}, {Size: -1}, {Size: 16}} {
+		if enc := l.Encode([]byte("hello")); string(enc) != "hello" {
+			t.Errorf("%+v should not frame anything: %q", l, enc)
+		}
+		if _, _, ok := l.Decode([]byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")); ok {
+			t.Errorf("%+v should never decode a frame", l)
+		}
+	}
+}
@@ -24,10 +24,24 @@ OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
 SOFTWARE.*/
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"errors"
 	"fmt"
+	"io"
+	"reflect"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
 )
 
 /*Command represents a command that can be sent over an Arbitor*/
@@ -49,14 +63,180 @@ type Command struct {
 	//This works in conjunction with the .Prototype in the following way:
 	//	c := fmt.Sprintf(.Prototype, v ... interface{}) #must not contain %!, a sign of too many/few/wrong parameters
 	//	CommandRegexp.MatchString(c) #must be true, so values cannot be out of bounds, etc
+	//If nil, any command formed is accepted
 	CommandRegexp *regexp.Regexp
 
+	//DefaultArgs are positional defaults for the Prototype's placeholders, used by Bytes for any trailing
+	//placeholders the caller does not supply args for.  Args that are supplied override them positionally,
+	//so leading entries that callers always supply may be anything, such as nil
+	DefaultArgs []interface{}
+
+	//CoerceArgs has Bytes convert string args to what their verb in the Prototype needs, for args that come
+	//from string based config: an integer for %d, %x, %o, %b, %c and %U and * widths, a float for %e, %f and
+	//%g, and a bool for %t.  Other verbs take strings as they are.  Explicit arg indexes such as %[1]d are
+	//not supported
+	CoerceArgs bool
+
+	//ValidateArgs, if not nil, checks the args given to Bytes before they are formatted, for rules a
+	//CommandRegexp cannot express well, such as "port must be 1..48".  It sees the args after any
+	//DefaultArgs and CoerceArgs are applied.  A non-nil error fails Bytes with ErrBytesArgs wrapping it, so
+	//Control returns it without anything going on the wire
+	ValidateArgs func(args []interface{}) error
+
 	//Response is a regexp that should match good/positive/affirmative responses.
 	Response *regexp.Regexp
 
+	//ResponseFunc, if not nil, gives the Response pattern for each call from the same args that form the
+	//command, after any DefaultArgs and CoerceArgs, in place of Response.  A reply tagged with a sequence
+	//number such as "REPLY:42" can then only match the request that sent 42, never a stale one.  Compiling
+	//a fresh pattern each call is fine, as only so many are kept for AnchorEnd and Streaming
+	ResponseFunc func(args []interface{}) *regexp.Regexp
+
 	//Error is a regexp that should match bad/negative/failure responses
 	Error *regexp.Regexp
 
+	//ErrorCodeGroup, when positive, is the submatch of Error holding a numeric error code.  An Error match
+	//then fails the command with a DeviceError carrying the code, rather than plain ErrMatch
+	ErrorCodeGroup int
+
+	//AnchorEnd requires Response, Error, ResponseLiteral and ErrorLiteral to match at the very end of what has
+	//been received so far, rather than anywhere in it, for devices whose reply is a suffix that might also
+	//turn up part way through.  It does not mix with a Trailer
+	AnchorEnd bool
+
+	//ResponseLiteral, if not empty, is a plain substring that matches good/positive/affirmative responses.
+	//It takes precedence over Response, and needs no escaping of regexp metacharacters
+	ResponseLiteral string
+
+	//ErrorLiteral, if not empty, is a plain substring that matches bad/negative/failure responses.
+	//It takes precedence over Error
+	ErrorLiteral string
+
+	//EchoConfirm, for devices that confirm a command by echoing it back, matches good responses against the
+	//exact bytes sent, in place of Response and ResponseLiteral.  It cannot be combined with a Codec,
+	//LengthPrefix or ETX framing, and such Commands fail with ErrEchoFramed without being sent
+	EchoConfirm bool
+
+	//STX and ETX, when ETX is not 0, frame replies as STX payload ETX.  A complete frame takes the place of
+	//a Response match, anything before STX is discarded, and Response.Bytes is just the payload.  If STX
+	//is 0, the payload is everything up to ETX
+	STX, ETX byte
+
+	//LengthPrefix, when its Size is not 0, frames replies as a binary length header followed by exactly that
+	//many payload bytes.  A complete payload takes the place of a Response match, and Response.Bytes is just
+	//the payload.  Any bytes beyond the payload are ignored
+	LengthPrefix LengthPrefix
+
+	//Codec, if not nil, frames both ways.  The request is passed through its Encode before going on the wire,
+	//and a complete frame from its Decode takes the place of a Response match, with Response.Bytes being the
+	//frame.  It takes precedence over LengthPrefix and STX/ETX, which are the same as a LengthPrefix or
+	//FrameCodec that only frames replies
+	Codec Codec
+
+	//SilenceIsSuccess is for commands the device acknowledges by staying quiet.  If nothing at all arrives
+	//before Timeout the command succeeds with no Bytes, rather than failing with ErrTimeout.  Anything that
+	//does arrive is still checked as usual, and fails the command with ErrTimeout if it matches nothing
+	SilenceIsSuccess bool
+
+	//NegativeConfirm is for watching for faults, such as after a start command.  The command waits out its
+	//whole Timeout, failing with ErrMatch if Error (or ErrorLiteral) matches meanwhile, and otherwise
+	//succeeding with whatever was received.  Response and any framing are not used
+	NegativeConfirm bool
+
+	//SoftTimeout, when positive, is how long the command should take.  A Response that takes longer, even
+	//if successful, has Slow set, so degrading devices can be spotted before commands start failing
+	SoftTimeout time.Duration
+
+	//ReadWait is how long each read off the connection blocks waiting for data while the command is in
+	//flight, never past Timeout.  The default of 1ms suits fast local devices, while a longer wait cuts down
+	//on polling for slow commands over slow links, at the cost of holding off Close and context cancellation
+	//for up to ReadWait
+	ReadWait time.Duration
+
+	//IgnoreFor discards whatever arrives for this long after the request is sent, for sleepy devices that
+	//echo or make noise while waking before sending the real reply.  Response and Error are only looked
+	//for in what arrives after it, and Timeout still counts from the request, so it must allow for IgnoreFor
+	IgnoreFor time.Duration
+
+	//MinResponseBytes is the number of bytes that must be buffered before Response or Error are checked
+	//at all.  This keeps replies that straddle several reads from matching early on a partial reply
+	MinResponseBytes int
+
+	//MaxResponseBytes, when positive, fails the command with ErrResponseTooLarge as soon as more than this
+	//many bytes are buffered without a match, rather than buffering a flood until Timeout.  Response.Bytes
+	//is then the first MaxResponseBytes bytes
+	MaxResponseBytes int
+
+	//Lookback, when positive, has Response, Error and CooldownResponse only matched against the last Lookback
+	//bytes buffered, so older unsolicited output from a chatty device cannot satisfy the command, and
+	//matching costs no more as the buffer grows.  Response.Bytes, ReturnAll included, then come from that
+	//window.  The default of 0 matches against everything buffered
+	Lookback int
+
+	//Decompress, if not CompressNone, decompresses the Response.Bytes of a successful reply, after any framing,
+	//TrimResponse or Validate.  Failures to decompress fail the command with an error matching ErrDecompress,
+	//as do replies that decompress to more than MaxResponseBytes, or MaxDecompressed if that is not set
+	Decompress Compression
+
+	//Encoding, if not nil, is the character encoding of a text device's replies, such as charmap.ISO8859_1 or
+	//unicode.UTF16.  The Response.Bytes of a successful reply are transcoded from it to UTF-8 last of all, and
+	//invalid sequences (including any U+FFFD) fail the command with an error matching ErrDecode
+	Encoding encoding.Encoding
+
+	//TrimResponse strips one trailing line terminator ("\r\n", "\n", or "\r") from the Response.Bytes of a
+	//successful reply.  Nothing else is removed
+	TrimResponse bool
+
+	//Extract, if not nil, produces the Response.Bytes handed back on a successful match from the
+	//Response regexp and the incoming buffer.  When nil, the first match of Response (re.Find(buf)) is used
+	Extract func(re *regexp.Regexp, buf []byte) []byte
+
+	//ReturnAll makes a successful match return everything received up to and including the match of
+	//Response (or ResponseLiteral), such as a whole multi-line reply ending in a prompt, rather than just the
+	//match.  It takes the place of Extract
+	ReturnAll bool
+
+	//Trailer, if not nil, matches junk the device sends after the reply proper, such as a prompt or a status
+	//byte.  A reply is only complete once the Trailer has also arrived after it, and the Trailer is discarded
+	//rather than left to turn up at the start of the next reply.  It is never part of Response.Bytes.  If the
+	//Timeout runs out waiting on the Trailer alone, the reply is handed back as though it had arrived
+	Trailer *regexp.Regexp
+
+	//Validate, if not nil, is the final say on a reply once Response (or ResponseLiteral) has matched.  It
+	//is handed the bytes that would be returned and reports whether they are ok.  If not ok, isError
+	//decides between failing the command with ErrValidate and continuing to wait for more bytes
+	Validate func(b []byte) (ok bool, isError bool)
+
+	//CooldownResponse, if not nil, matches "busy, try again later" replies.  Control then waits Cooldown and
+	//re-issues the command, up to CooldownRetries times, and if the device is still busy fails with ErrCooldown
+	CooldownResponse *regexp.Regexp
+	Cooldown         time.Duration //how long to wait after a CooldownResponse before re-issuing
+	CooldownRetries  int           //how many times to re-issue after a CooldownResponse
+
+	//ContinuationPattern, if not nil, matches paging prompts such as "--More--" in the middle of a reply.  Each
+	//time a new one arrives, ContinuationInput is sent to get the rest, until the reply is complete or Timeout
+	//runs out.  The prompts are left in the reply
+	ContinuationPattern *regexp.Regexp
+	ContinuationInput   string //sent for each ContinuationPattern match, such as " " or "\r"
+
+	//Streaming is for very large replies.  Each poll, Response, Error and CooldownResponse are only searched
+	//for in the newly arrived bytes plus a small overlap, sized to the longest match they can make, rather
+	//than the whole reply so far.  It has no effect if any of them can match unboundedly long text, such
+	//as with * or +, or with a Codec, LengthPrefix or ETX framing.  The reply is still kept whole for
+	//Response.Bytes
+	Streaming bool
+
+	//CacheTTL, when positive, has successful Responses cached for that long, for queries such as a serial
+	//number that do not change.  Within the TTL, Control hands back the cached Response for the same
+	//command and formed bytes without going to the device.  See Arbiter.CacheClear
+	CacheTTL time.Duration
+
+	//Fallback, if not nil, is another form of the command, such as a legacy format for older firmware, that
+	//Control issues with the same args if this one fails with ErrTimeout or ErrMatch.  Its own Fallback is
+	//tried in turn, up to MaxFallbackDepth deep, and Response.Fallback tells which form answered.  Each form
+	//waits its own Timeout, but one bounded by ControlDeadline or ControlContext shares what is left of it
+	Fallback *Command
+
 	//Description is a human readable string of a brief explanaition of the commands purpose
 	Description string
 }
@@ -74,9 +254,44 @@ func (c Command) String() string {
 		case string:
 			str = s
 		}
-		return strings.Replace(strings.Replace(str, "\r", "\\r", -1), "\n", "\\n", -1)
+		return escape(str)
+	}
+	return fmt.Sprintf("%s: %v Prototype:%q CommandRegexp:%q Expect:%q Error:%q", sanitize(c.Name), c.Timeout, sanitize(c.Prototype), sanitize(c.CommandRegexp), sanitize(c.Response), sanitize(c.Error))
+}
+
+//escape escapes anything unprintable in str (\r, \n, \x01, ...), leaving printable text as-is
+func escape(str string) string {
+	var b strings.Builder
+	for i, w := 0, 0; i < len(str); i += w {
+		var r rune
+		r, w = utf8.DecodeRuneInString(str[i:])
+		switch {
+		case r == utf8.RuneError && w == 1: //not valid utf8
+			fmt.Fprintf(&b, "\\x%02x", str[i])
+		case strconv.IsPrint(r):
+			b.WriteRune(r)
+		default:
+			q := strconv.QuoteRune(r)
+			b.WriteString(q[1 : len(q)-1])
+		}
 	}
-	return fmt.Sprintf("%s: %v Prototype:%q CommandRegexp:%q Expect:%q Error:%q", c.Name, c.Timeout, sanitize(c.Prototype), sanitize(c.CommandRegexp), sanitize(c.Response), sanitize(c.Error))
+	return b.String()
+}
+
+/*MaxFallbackDepth bounds how many Command.Fallback forms Control tries after the command itself, so a
+chain that loops back on itself cannot retry forever*/
+var MaxFallbackDepth = 4
+
+//WithTimeout returns a copy of c with Timeout set to d.  c is left untouched
+func (c Command) WithTimeout(d time.Duration) Command {
+	c.Timeout = d
+	return c
+}
+
+//WithPrototype returns a copy of c with Prototype set to p.  c is left untouched
+func (c Command) WithPrototype(p string) Command {
+	c.Prototype = p
+	return c
 }
 
 //ErrBytesArgs is returned when calling Bytes if any of the following occur:
@@ -88,21 +303,57 @@ var ErrBytesArgs = fmt.Errorf("Proper arguments not provided to expand command i
 //ErrBytesFormat is returned when the args used to populate the command are forming an invalid command
 var ErrBytesFormat = fmt.Errorf("Formed command does not match allowable format for outgoing commands")
 
+//verbatim is a []byte arg to Bytes, which formats as its raw bytes for any verb
+type verbatim []byte
+
+//Format implements fmt.Formatter
+func (v verbatim) Format(f fmt.State, verb rune) {
+	f.Write(v)
+}
+
 /*Bytes returnes the raw bytes that should be sent to the interface based on the Command.Prototype and
 any optional arguments passed to it. It will return a byte slice and one of the following errors:
 
 	ErrBytesArgs if either too many, not enough, or the wrong type of args are provided
 	ErrBytesFormat if the assembled byte slice does not match the required Command.CommandRegexp
+	ErrLengthPrefix if replies are framed by a LengthPrefix of unusable Size
+	ErrEchoFramed if EchoConfirm is set along with framed replies
 	nil if a byte slice was successfully formed
+
+Any []byte args are inserted as-is at their placeholder, regardless of the verb, so binary fields can be
+embedded in otherwise text commands.  If fewer args than Command.DefaultArgs are passed, the remainder are
+taken from DefaultArgs before any of the above checks, and with Command.CoerceArgs set string args are then
+converted to their verb's type.  Command.ValidateArgs then gets its say before anything is formatted.
 */
 func (c Command) Bytes(v ...interface{}) ([]byte, error) {
-	str := fmt.Sprintf(c.Prototype, v...)
-	if strings.Contains(str, "%!") {
+	if err := c.framing(); err != nil { //no sense sending what can never be answered
+		return nil, err
+	}
+	v, err := c.args(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.ValidateArgs != nil {
+		if err := c.ValidateArgs(v); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBytesArgs, err)
+		}
+	}
+	//[]byte args are spliced in verbatim, whatever the verb.  Since they may hold anything, including
+	//"%!", the args are checked against the Prototype with them blanked out
+	raw, blanked := make([]interface{}, len(v)), make([]interface{}, len(v))
+	for i, arg := range v {
+		raw[i], blanked[i] = arg, arg
+		if b, ok := arg.([]byte); ok {
+			raw[i], blanked[i] = verbatim(b), verbatim(nil)
+		}
+	}
+	str := fmt.Sprintf(c.Prototype, raw...)
+	if strings.Contains(fmt.Sprintf(c.Prototype, blanked...), "%!") {
 		// fmt.Printf("Arbiter: Malformed command: [%s] with args '%v'! I formed %q, which is incomplete", c, v, str)
 		return []byte(str), ErrBytesArgs
 	}
 	//make sure whatever we stuffed matches the provided regexp
-	if !c.CommandRegexp.MatchString(str) {
+	if c.CommandRegexp != nil && !c.CommandRegexp.MatchString(str) {
 		// fmt.Printf("Malformed command: [%s] with args '%v'! I formed %q which does not match required regex %q", c, v, str, c.CommandRegexp.String())
 		return []byte(str), ErrBytesFormat
 	}
@@ -110,6 +361,523 @@ func (c Command) Bytes(v ...interface{}) ([]byte, error) {
 
 }
 
+//args returns v as the Prototype gets it, filled in from DefaultArgs and coerced if need be
+func (c Command) args(v []interface{}) ([]interface{}, error) {
+	if len(v) < len(c.DefaultArgs) { //fill in the rest from the defaults
+		v = append(append([]interface{}(nil), v...), c.DefaultArgs[len(v):]...)
+	}
+	if c.CoerceArgs {
+		return c.coerce(v)
+	}
+	return v, nil
+}
+
+//bind returns c for one call with args, with Response taken from ResponseFunc if it is set.  args must
+//already have passed Bytes
+func (c Command) bind(args []interface{}) Command {
+	if c.ResponseFunc != nil {
+		v, _ := c.args(args)
+		c.Response = c.ResponseFunc(v)
+	}
+	return c
+}
+
+//verbs returns the verb for each arg the Prototype consumes, in order, with '*' for widths and precisions
+func (c Command) verbs() []rune {
+	var vs []rune
+	p := c.Prototype
+	for i := 0; i < len(p); i++ {
+		if p[i] != '%' {
+			continue
+		}
+		for i++; i < len(p); i++ { //skip flags, width and precision
+			if p[i] == '*' {
+				vs = append(vs, '*')
+			} else if !strings.ContainsRune("+-# 0123456789.", rune(p[i])) {
+				break
+			}
+		}
+		if i < len(p) && p[i] != '%' {
+			r, _ := utf8.DecodeRuneInString(p[i:])
+			vs = append(vs, r)
+		}
+	}
+	return vs
+}
+
+//coerce converts the string args in v to what their verbs need, see CoerceArgs
+func (c Command) coerce(v []interface{}) ([]interface{}, error) {
+	out := append([]interface{}(nil), v...)
+	for i, verb := range c.verbs() {
+		if i >= len(v) {
+			break
+		}
+		str, ok := v[i].(string)
+		if !ok {
+			continue
+		}
+		var err error
+		want, trimmed := "", strings.TrimSpace(str)
+		switch verb {
+		case 'd', 'x', 'X', 'o', 'O', 'b', 'c', 'U', '*':
+			want = "integer"
+			var n int64
+			if n, err = strconv.ParseInt(trimmed, 0, 64); verb == '*' {
+				out[i] = int(n)
+			} else {
+				out[i] = n
+			}
+		case 'e', 'E', 'f', 'F', 'g', 'G':
+			want = "float"
+			out[i], err = strconv.ParseFloat(trimmed, 64)
+		case 't':
+			want = "bool"
+			out[i], err = strconv.ParseBool(trimmed)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: arg %d %q is not a valid %s for %%%c", ErrBytesArgs, i, str, want, verb)
+		}
+	}
+	return out, nil
+}
+
+//isError checks if buf contains a failure response
+func (c Command) isError(buf []byte) bool {
+	if c.ErrorLiteral != "" {
+		return c.literalAt(buf, c.ErrorLiteral) >= 0
+	}
+	re := c.anchor(c.Error)
+	return re != nil && re.Match(buf)
+}
+
+//deviceError returns the error for an Error match in buf, a DeviceError if c has an ErrorCodeGroup
+func (c Command) deviceError(buf []byte) error {
+	if c.ErrorCodeGroup <= 0 || c.ErrorLiteral != "" || c.Error == nil {
+		return ErrMatch
+	}
+	m := c.anchor(c.Error).FindSubmatch(buf)
+	if c.ErrorCodeGroup >= len(m) {
+		return ErrMatch
+	}
+	code, err := strconv.Atoi(string(m[c.ErrorCodeGroup]))
+	if err != nil { //not a number after all
+		return ErrMatch
+	}
+	return DeviceError{Code: code, Raw: append([]byte(nil), m[0]...)} //dont alias the runner's buffer
+}
+
+//isResponse checks if buf contains a successful response
+func (c Command) isResponse(buf []byte) bool {
+	if c.ResponseLiteral != "" {
+		return c.literalAt(buf, c.ResponseLiteral) >= 0
+	}
+	re := c.anchor(c.Response)
+	return re != nil && re.Match(buf)
+}
+
+//literalAt returns where lit is first found in buf, or -1.  With AnchorEnd it must be at the very end
+func (c Command) literalAt(buf []byte, lit string) int {
+	if !c.AnchorEnd {
+		return bytes.Index(buf, []byte(lit))
+	}
+	if !bytes.HasSuffix(buf, []byte(lit)) {
+		return -1
+	}
+	return len(buf) - len(lit)
+}
+
+//reCacheSize is how many regexps a reCache holds onto
+const reCacheSize = 256
+
+/*reCache holds what has been worked out from regexps, keyed by the *regexp.Regexp itself, so regexps with
+the same source compiled differently, such as with Longest, are kept apart.  It holds at most reCacheSize,
+dropping the least recently used, so regexps made per call, as by Command.ResponseFunc, do not pile up*/
+type reCache[V any] struct {
+	mu    sync.Mutex
+	items map[*regexp.Regexp]*list.Element
+	lru   list.List //of reCacheItem, most recently used first
+}
+
+//reCacheItem is one entry of a reCache
+type reCacheItem[V any] struct {
+	re *regexp.Regexp
+	v  V
+}
+
+//get returns what calc works out for re, only calling it if re is not already cached
+func (c *reCache[V]) get(re *regexp.Regexp, calc func(re *regexp.Regexp) V) V {
+	c.mu.Lock()
+	if e, ok := c.items[re]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(reCacheItem[V]).v
+	}
+	c.mu.Unlock()
+	v := calc(re) //outside the lock, as compiling can be slow
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.items == nil {
+		c.items = map[*regexp.Regexp]*list.Element{}
+	}
+	if _, ok := c.items[re]; !ok {
+		c.items[re] = c.lru.PushFront(reCacheItem[V]{re: re, v: v})
+		if c.lru.Len() > reCacheSize {
+			delete(c.items, c.lru.Remove(c.lru.Back()).(reCacheItem[V]).re)
+		}
+	}
+	return v
+}
+
+//len returns how many regexps are cached
+func (c *reCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+//anchoring is the AnchorEnd form of a regexp, or why there is none
+type anchoring struct {
+	re  *regexp.Regexp
+	err error
+}
+
+//anchoredRe caches the AnchorEnd forms of regexps, as they are needed on every poll
+var anchoredRe reCache[anchoring]
+
+/*anchor returns re, or with AnchorEnd set, a regexp that only matches re at the end of the input.  That is
+nil if it does not compile, such as when re already nests as deep as regexp allows, so nothing matches and
+match fails the command with why*/
+func (c Command) anchor(re *regexp.Regexp) *regexp.Regexp {
+	a, _ := c.anchored(re)
+	return a
+}
+
+//anchored is anchor, also returning why there is no AnchorEnd form of re
+func (c Command) anchored(re *regexp.Regexp) (*regexp.Regexp, error) {
+	if !c.AnchorEnd || re == nil {
+		return re, nil
+	}
+	a := anchoredRe.get(re, func(re *regexp.Regexp) anchoring {
+		a, err := regexp.Compile(`(?:` + re.String() + `)$`)
+		if err != nil {
+			err = fmt.Errorf("Unable to anchor regexp for AnchorEnd: %w", err)
+		}
+		return anchoring{re: a, err: err}
+	})
+	return a.re, a.err
+}
+
+//matchLen caches maxMatchLen of regexps, as Streaming needs them on every poll
+var matchLen reCache[int]
+
+//maxMatchLen returns the most bytes re can match, or -1 if there is no limit
+func maxMatchLen(re *regexp.Regexp) int {
+	return matchLen.get(re, func(re *regexp.Regexp) int {
+		tree, err := syntax.Parse(re.String(), syntax.Perl)
+		if err != nil { //such as from CompilePOSIX, so assume the worst
+			return -1
+		}
+		return treeLen(tree.Simplify())
+	})
+}
+
+//treeLen returns the most bytes re can match, or -1 if there is no limit
+func treeLen(re *syntax.Regexp) int {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 { //other cases may encode longer
+			return len(re.Rune) * utf8.UTFMax
+		}
+		return len(string(re.Rune))
+	case syntax.OpCharClass, syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return utf8.UTFMax
+	case syntax.OpCapture, syntax.OpQuest:
+		return treeLen(re.Sub[0])
+	case syntax.OpRepeat:
+		n := treeLen(re.Sub[0])
+		if re.Max < 0 || n < 0 {
+			return -1
+		}
+		return n * re.Max
+	case syntax.OpStar, syntax.OpPlus:
+		return -1
+	case syntax.OpConcat, syntax.OpAlternate:
+		total := 0
+		for _, sub := range re.Sub {
+			n := treeLen(sub)
+			switch {
+			case n < 0:
+				return -1
+			case re.Op == syntax.OpConcat:
+				total += n
+			case n > total:
+				total = n
+			}
+		}
+		return total
+	}
+	return 0 //empty matches and assertions such as ^ and \b
+}
+
+//window returns the most bytes any Streaming match can span, or -1 if c cannot be streamed
+func (c Command) window() int {
+	if c.codec() != nil {
+		return -1
+	}
+	w := len(c.ResponseLiteral)
+	if len(c.ErrorLiteral) > w {
+		w = len(c.ErrorLiteral)
+	}
+	res := []*regexp.Regexp{c.CooldownResponse}
+	if c.ResponseLiteral == "" {
+		res = append(res, c.Response)
+	}
+	if c.ErrorLiteral == "" {
+		res = append(res, c.Error)
+	}
+	for _, re := range res {
+		if re == nil {
+			continue
+		}
+		n := maxMatchLen(re)
+		if n < 0 {
+			return -1
+		}
+		if n > w {
+			w = n
+		}
+	}
+	return w
+}
+
+/*mayMatch reports if match could form a reply from buf, given that it could not from buf[:from].  With
+Streaming, only the tail of buf that a new match could span is searched, plus a rune more so assertions
+like ^ and \b see what came before.  Otherwise it is always true*/
+func (c Command) mayMatch(buf []byte, from int) bool {
+	if !c.Streaming {
+		return true
+	}
+	w := c.window()
+	if w < 0 {
+		return true
+	}
+	if from -= w + utf8.UTFMax; from > 0 {
+		buf = buf[from:]
+	}
+	return c.isError(buf) || c.isResponse(buf) || c.CooldownResponse != nil && c.CooldownResponse.Match(buf)
+}
+
+//codec returns the Codec framing replies to c, from Codec, LengthPrefix, or STX and ETX in that order
+func (c Command) codec() Codec {
+	switch {
+	case c.Codec != nil:
+		return c.Codec
+	case c.LengthPrefix.Size != 0:
+		return c.LengthPrefix
+	case c.ETX != 0:
+		return FrameCodec{STX: c.STX, ETX: c.ETX}
+	}
+	return nil
+}
+
+//ErrEchoFramed is returned for a Command with EchoConfirm that also frames its replies
+var ErrEchoFramed = errors.New("EchoConfirm cannot be used with framed replies")
+
+//framing returns why the framing of replies to c cannot work, nil if it can
+func (c Command) framing() error {
+	codec := c.codec()
+	if codec != nil && c.EchoConfirm { //the frame would take the place of the echo
+		return ErrEchoFramed
+	}
+	if l, ok := codec.(LengthPrefix); ok {
+		return l.check()
+	}
+	return nil
+}
+
+//replyEnd returns the offset in buf just past the reply that match found, ie where any Trailer starts
+func (c Command) replyEnd(buf []byte, b []byte) int {
+	if codec := c.codec(); codec != nil {
+		_, n, _ := codec.Decode(buf)
+		return n
+	}
+	switch {
+	case c.ResponseLiteral != "":
+		return c.literalAt(buf, c.ResponseLiteral) + len(c.ResponseLiteral)
+	}
+	return c.anchor(c.Response).FindIndex(buf)[1]
+}
+
+/*LengthPrefix describes the length header at the very start of a binary reply, as used by
+Command.LengthPrefix.  The header holds the number of payload bytes that follow it*/
+type LengthPrefix struct {
+	Size         int  //size of the header in bytes, one of 1, 2, 4 or 8.  0 disables length framing
+	LittleEndian bool //byte order of the header, big-endian (network order) by default
+}
+
+//extract returns the bytes that a successful match on buf should return.  For a ResponseLiteral
+//this is simply the first occurrence of the literal, or everything up to it for ReturnAll
+func (c Command) extract(buf []byte) []byte {
+	if c.ResponseLiteral != "" {
+		i := c.literalAt(buf, c.ResponseLiteral)
+		if c.ReturnAll {
+			return buf[:i+len(c.ResponseLiteral)]
+		}
+		return buf[i : i+len(c.ResponseLiteral)]
+	}
+	re := c.anchor(c.Response)
+	if c.ReturnAll {
+		return buf[:re.FindIndex(buf)[1]]
+	}
+	if c.Extract != nil {
+		return c.Extract(re, buf)
+	}
+	return re.Find(buf)
+}
+
+//trim removes a single trailing line terminator from b if c.TrimResponse is set
+func (c Command) trim(b []byte) []byte {
+	if c.TrimResponse {
+		for _, term := range []string{"\r\n", "\n", "\r"} {
+			if bytes.HasSuffix(b, []byte(term)) {
+				return b[:len(b)-len(term)]
+			}
+		}
+	}
+	return b
+}
+
+/*match checks buf for a complete reply to c.  Once formed is true, b and err are what should be handed
+back in the Response.  Until then, more bytes are needed*/
+func (c Command) match(buf []byte) (b []byte, formed bool, err error) {
+	if len(buf) < c.MinResponseBytes { //not enough to bother matching
+		return nil, false, nil
+	}
+	if n := c.Lookback; n > 0 && len(buf) > n { //anything older cannot be the reply
+		buf = buf[len(buf)-n:]
+	}
+	if _, err := c.anchored(c.Response); err != nil { //can never match, so dont wait for the timeout
+		return buf, true, err
+	}
+	if _, err := c.anchored(c.Error); err != nil {
+		return buf, true, err
+	}
+	if err := c.framing(); err != nil {
+		return buf, true, err
+	}
+	if c.CooldownResponse != nil && c.CooldownResponse.Match(buf) {
+		return buf, true, ErrCooldown
+	}
+	if c.isError(buf) {
+		return buf, true, c.deviceError(buf)
+	}
+	if c.NegativeConfirm { //only a fault, or the timeout, ends it
+		return nil, false, nil
+	}
+	var ok bool
+	if codec := c.codec(); codec != nil {
+		b, _, ok = codec.Decode(buf)
+	} else if ok = c.isResponse(buf); ok {
+		b = c.extract(buf)
+	}
+	if !ok {
+		return nil, false, nil //keep waiting
+	}
+	if c.Validate != nil {
+		switch valid, isError := c.Validate(b); {
+		case !valid && isError:
+			return buf, true, ErrValidate
+		case !valid:
+			return nil, false, nil
+		}
+	}
+	if c.Trailer != nil && !c.Trailer.Match(buf[c.replyEnd(buf, b):]) { //wait for it, so it cannot spill into the next reply
+		return nil, false, nil
+	}
+	if b, err = c.decompress(c.trim(b)); err != nil {
+		return buf, true, err
+	}
+	if b, err = c.decode(b); err != nil {
+		return buf, true, err
+	}
+	return b, true, nil
+}
+
+//untrailed is match for when time is up waiting on a Trailer, reporting if the reply before it is complete
+func (c Command) untrailed(buf []byte) ([]byte, bool) {
+	if c.Trailer == nil {
+		return nil, false
+	}
+	c.Trailer = nil
+	b, formed, err := c.match(buf)
+	return b, formed && err == nil
+}
+
+//ErrDecode is returned, wrapped with any underlying error, if a reply is not valid in Command.Encoding
+var ErrDecode = errors.New("Unable to decode response")
+
+//decode transcodes b from c.Encoding to UTF-8
+func (c Command) decode(b []byte) ([]byte, error) {
+	if c.Encoding == nil {
+		return b, nil
+	}
+	u, err := c.Encoding.NewDecoder().Bytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecode, err)
+	}
+	if bytes.ContainsRune(u, utf8.RuneError) { //decoders swap invalid sequences for U+FFFD rather than failing
+		return nil, fmt.Errorf("%w: invalid %v", ErrDecode, c.Encoding)
+	}
+	return u, nil
+}
+
+//Compression is a compression format for Command.Decompress
+type Compression int
+
+//Compression formats
+const (
+	CompressNone Compression = iota //not compressed
+	CompressGzip                    //gzip, RFC 1952
+	CompressZlib                    //zlib, RFC 1950
+)
+
+//ErrDecompress is returned, wrapped with the underlying error, if a reply fails to decompress
+var ErrDecompress = errors.New("Unable to decompress response")
+
+/*MaxDecompressed bounds how large a reply may grow when decompressed, for Commands without a
+MaxResponseBytes, so a small reply cannot expand to exhaust memory*/
+var MaxDecompressed = 16 << 20
+
+//decompress decompresses b according to c.Decompress
+func (c Command) decompress(b []byte) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch c.Decompress {
+	case CompressNone:
+		return b, nil
+	case CompressGzip:
+		r, err = gzip.NewReader(bytes.NewReader(b))
+	case CompressZlib:
+		r, err = zlib.NewReader(bytes.NewReader(b))
+	default:
+		err = fmt.Errorf("Unknown Compression %d", c.Decompress)
+	}
+	if err == nil {
+		defer r.Close()
+		max := c.MaxResponseBytes
+		if max <= 0 {
+			max = MaxDecompressed
+		}
+		if b, err = io.ReadAll(io.LimitReader(r, int64(max)+1)); err == nil && len(b) > max {
+			err = fmt.Errorf("%w: over %d bytes", ErrResponseTooLarge, max)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecompress, err)
+	}
+	return b, nil
+}
+
 //Commands is map of Command structure where the key should be Command.Name
 type Commands map[string]Command
 
@@ -137,3 +905,233 @@ func (c Commands) JSONLabels() (r string) {
 	r += "]"
 	return
 }
+
+/*CatalogRegistry holds a Commands catalog per device model, so the right catalog can be picked for a
+device by the model it reports.  The zero value is an empty registry ready for use, and it is safe for
+concurrent use*/
+type CatalogRegistry struct {
+	mu       sync.RWMutex
+	catalogs map[string]Commands
+}
+
+//ErrUnknownModel is returned by CatalogRegistry.Lookup for models that were never Registered
+var ErrUnknownModel = errors.New("No catalog registered for model")
+
+//Register stores cmds as the catalog for model, replacing any already registered
+func (r *CatalogRegistry) Register(model string, cmds Commands) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.catalogs == nil {
+		r.catalogs = map[string]Commands{}
+	}
+	r.catalogs[model] = cmds
+}
+
+//Lookup returns the catalog Registered for model, or an error matching ErrUnknownModel
+func (r *CatalogRegistry) Lookup(model string) (Commands, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmds, ok := r.catalogs[model]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownModel, model)
+	}
+	return cmds, nil
+}
+
+/*DiffCommands compares two catalogs by name, returning the sorted names only in b (added), only in
+a (removed), and in both but with different definitions (changed).  Regexps are compared by their
+source strings, and Fallbacks field by field in turn, as far as MaxFallbackDepth.  Extract and Validate can
+only be compared by whether they are set*/
+func DiffCommands(a, b Commands) (added, removed, changed []string) {
+	for name, cmd := range b {
+		if was, ok := a[name]; !ok {
+			added = append(added, name)
+		} else if !sameCommand(was, cmd, MaxFallbackDepth) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return
+}
+
+//sameCommand reports if a and b are defined the same, as described in DiffCommands, comparing depth
+//levels of Fallback
+func sameCommand(a, b Command, depth int) bool {
+	same := func(x, y *regexp.Regexp) bool {
+		return x == y || x != nil && y != nil && x.String() == y.String()
+	}
+	return a.Name == b.Name && a.Timeout == b.Timeout && a.Prototype == b.Prototype &&
+		reflect.DeepEqual(a.DefaultArgs, b.DefaultArgs) && a.CoerceArgs == b.CoerceArgs &&
+		same(a.CommandRegexp, b.CommandRegexp) && same(a.Response, b.Response) && same(a.Error, b.Error) &&
+		a.ErrorCodeGroup == b.ErrorCodeGroup && (a.ValidateArgs == nil) == (b.ValidateArgs == nil) &&
+		(a.ResponseFunc == nil) == (b.ResponseFunc == nil) &&
+		a.ResponseLiteral == b.ResponseLiteral && a.ErrorLiteral == b.ErrorLiteral && a.AnchorEnd == b.AnchorEnd &&
+		a.EchoConfirm == b.EchoConfirm && a.SilenceIsSuccess == b.SilenceIsSuccess &&
+		a.NegativeConfirm == b.NegativeConfirm &&
+		a.STX == b.STX && a.ETX == b.ETX && reflect.DeepEqual(a.Codec, b.Codec) &&
+		a.LengthPrefix == b.LengthPrefix && a.ReadWait == b.ReadWait && a.SoftTimeout == b.SoftTimeout &&
+		a.IgnoreFor == b.IgnoreFor &&
+		a.MinResponseBytes == b.MinResponseBytes && a.MaxResponseBytes == b.MaxResponseBytes && a.Lookback == b.Lookback &&
+		a.TrimResponse == b.TrimResponse && a.Decompress == b.Decompress &&
+		fmt.Sprint(a.Encoding) == fmt.Sprint(b.Encoding) && a.ReturnAll == b.ReturnAll && (a.Extract == nil) == (b.Extract == nil) &&
+		(a.Validate == nil) == (b.Validate == nil) && same(a.CooldownResponse, b.CooldownResponse) &&
+		a.Cooldown == b.Cooldown && a.CooldownRetries == b.CooldownRetries &&
+		same(a.ContinuationPattern, b.ContinuationPattern) && same(a.Trailer, b.Trailer) && a.ContinuationInput == b.ContinuationInput &&
+		a.Streaming == b.Streaming && a.CacheTTL == b.CacheTTL &&
+		(a.Fallback == b.Fallback || a.Fallback != nil && b.Fallback != nil && (depth <= 0 || sameCommand(*a.Fallback, *b.Fallback, depth-1))) &&
+		a.Description == b.Description
+}
+
+//CommandSpec is the uncompiled form of a Command, with regexps given as plain strings.  It is
+//turned into a Command via CompileCommands
+type CommandSpec struct {
+	Timeout         time.Duration //see Command.Timeout
+	Prototype       string        //see Command.Prototype
+	CommandRegexp   string        //source of Command.CommandRegexp, none if empty
+	Response        string        //source of Command.Response, none if empty
+	Error           string        //source of Command.Error, none if empty
+	ResponseLiteral string        //see Command.ResponseLiteral
+	ErrorLiteral    string        //see Command.ErrorLiteral
+	Description     string        //see Command.Description
+}
+
+/*CompileCommands compiles a map of CommandSpecs into Commands. The map key is used as the Command.Name.
+If any of the regexps fail to compile, a nil Commands is returned along with an error naming the
+offending command and field.  Identical regexp sources are only compiled once, and the resulting
+*regexp.Regexp shared by every command using it.  An empty source leaves the regexp nil, as an empty
+regexp would match anything*/
+func CompileCommands(defs map[string]CommandSpec) (Commands, error) {
+	cmds := Commands{}
+	compiled := map[string]*regexp.Regexp{} //interned by source
+	for name, spec := range defs {
+		cmd, field, err := spec.compile(name, compiled)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to compile %s of command %q: %v", field, name, err)
+		}
+		cmds[name] = cmd
+	}
+	return cmds, nil
+}
+
+//compile turns spec into the Command called name, reusing and adding to the regexps in compiled.  On
+//error, field names the regexp that failed
+func (spec CommandSpec) compile(name string, compiled map[string]*regexp.Regexp) (cmd Command, field string, err error) {
+	cmd = Command{
+		Name:            name,
+		Timeout:         spec.Timeout,
+		Prototype:       spec.Prototype,
+		ResponseLiteral: spec.ResponseLiteral,
+		ErrorLiteral:    spec.ErrorLiteral,
+		Description:     spec.Description,
+	}
+	fields := []struct {
+		field string
+		src   string
+		dst   **regexp.Regexp
+	}{
+		{"CommandRegexp", spec.CommandRegexp, &cmd.CommandRegexp},
+		{"Response", spec.Response, &cmd.Response},
+		{"Error", spec.Error, &cmd.Error},
+	}
+	for _, f := range fields {
+		if f.src == "" { //left nil, rather than matching everything
+			continue
+		}
+		re, ok := compiled[f.src]
+		if !ok {
+			if re, err = regexp.Compile(f.src); err != nil {
+				return Command{}, f.field, err
+			}
+			compiled[f.src] = re
+		}
+		*f.dst = re
+	}
+	return cmd, "", nil
+}
+
+/*BuildCatalog builds Commands from the struct tags of v, a struct or pointer to one, so a catalog can be
+declared as a typed Go struct.  Every field with a "prototype" tag is a command, and nested structs are
+searched too.  The tags are:
+
+	name        - the Command.Name and Commands key, the field name if not given
+	prototype   - Command.Prototype
+	regexp      - source of Command.CommandRegexp
+	response    - source of Command.Response
+	error       - source of Command.Error
+	timeout     - Command.Timeout, in time.ParseDuration form such as "1.5s"
+	description - Command.Description
+
+such as
+
+	type Catalog struct {
+		Ping arbiter.Command `prototype:"\r" regexp:"\r" response:"\r" timeout:"1s"`
+	}
+
+Tag values are Go quoted strings, so backslashes in regexps must be doubled.  A missing regexp, response
+or error tag leaves that regexp nil, rather than one matching anything.  If v is a pointer, fields of
+type Command are also set to the compiled command.  Any error names the path of the offending field, such
+as "Catalog.Sensors.Temp"*/
+func BuildCatalog(v interface{}) (Commands, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("BuildCatalog needs a struct or pointer to one, not %T", v)
+	}
+	cmds := Commands{}
+	return cmds, buildCatalog(rv, rv.Type().Name(), cmds, map[string]*regexp.Regexp{})
+}
+
+//buildCatalog adds the commands tagged on the fields of struct rv, found at path, to cmds
+func buildCatalog(rv reflect.Value, path string, cmds Commands, compiled map[string]*regexp.Regexp) error {
+	for i := 0; i < rv.NumField(); i++ {
+		f, fv := rv.Type().Field(i), rv.Field(i)
+		at := path + "." + f.Name
+		proto, ok := f.Tag.Lookup("prototype")
+		if !ok {
+			if f.Type.Kind() == reflect.Struct && f.Type != reflect.TypeOf(Command{}) {
+				if err := buildCatalog(fv, at, cmds, compiled); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		spec := CommandSpec{
+			Prototype:     proto,
+			CommandRegexp: f.Tag.Get("regexp"),
+			Response:      f.Tag.Get("response"),
+			Error:         f.Tag.Get("error"),
+			Description:   f.Tag.Get("description"),
+		}
+		if t, ok := f.Tag.Lookup("timeout"); ok {
+			var err error
+			if spec.Timeout, err = time.ParseDuration(t); err != nil {
+				return fmt.Errorf("Unable to parse timeout of %s: %v", at, err)
+			}
+		}
+		name := f.Tag.Get("name")
+		if name == "" {
+			name = f.Name
+		}
+		if _, dup := cmds[name]; dup {
+			return fmt.Errorf("Duplicate command %q at %s", name, at)
+		}
+		cmd, field, err := spec.compile(name, compiled)
+		if err != nil {
+			return fmt.Errorf("Unable to compile %s of %s: %v", field, at, err)
+		}
+		cmds[name] = cmd
+		if fv.CanSet() && fv.Type() == reflect.TypeOf(cmd) {
+			fv.Set(reflect.ValueOf(cmd))
+		}
+	}
+	return nil
+}
@@ -25,10 +25,20 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
 )
 
 func TestCommand_Bytes(t *testing.T) {
@@ -108,6 +118,14 @@ func TestCommand_String(t *testing.T) {
 			Error:         regexp.MustCompile(""),
 			Response:      nil,
 		},
+		`b\x01: 1s Prototype:"\\x02\\r\\xff" CommandRegexp:"\\x02" Expect:"\\x03\\n" Error:"\\t"`: Command{
+			Name:          "b\x01",
+			Timeout:       1 * time.Second,
+			Prototype:     "\x02\r\xff",
+			CommandRegexp: regexp.MustCompile("\x02"),
+			Error:         regexp.MustCompile("\t"),
+			Response:      regexp.MustCompile("\x03\n"),
+		},
 	}
 	for val, cmd := range cmds {
 		if val != cmd.String() {
@@ -190,3 +208,675 @@ func TestResponse_String(t *testing.T) {
 		t.Fatalf("Response String() func not working")
 	}
 }
+
+func TestCompileCommands(t *testing.T) {
+	cmds, err := CompileCommands(map[string]CommandSpec{
+		"ping": CommandSpec{Timeout: 1 * time.Second, Prototype: "\r", CommandRegexp: "\r", Response: "\r", Error: "a^"},
+		"set":  CommandSpec{Timeout: 2 * time.Second, Prototype: "SET %02d\r", CommandRegexp: "SET [0-9]{2}\r", Response: "OK", Error: "ERR"},
+	})
+	if err != nil {
+		t.Fatalf("Valid specs should compile: %v", err)
+	}
+	if len(cmds) != 2 || cmds["set"].Name != "set" || cmds["set"].Timeout != 2*time.Second {
+		t.Fatalf("Compiled commands not populated properly: %v", cmds)
+	}
+	if b, err := cmds["set"].Bytes(4); err != nil || string(b) != "SET 04\r" {
+		t.Fatalf("Compiled command should form bytes: %q %v", b, err)
+	}
+
+	if cmds["ping"].CommandRegexp != cmds["ping"].Response {
+		t.Fatalf("Identical regexp sources should share one compiled regexp")
+	}
+
+	cmds, err = CompileCommands(map[string]CommandSpec{
+		"noerr":  CommandSpec{Prototype: "GO\r", CommandRegexp: "GO\r", Response: "OK"},
+		"noresp": CommandSpec{Prototype: "GO\r", Error: "ERR", ResponseLiteral: "OK"},
+	})
+	if err != nil || cmds["noerr"].Error != nil || cmds["noresp"].Response != nil || cmds["noresp"].CommandRegexp != nil {
+		t.Fatalf("Empty sources should leave the regexps nil: %v %v", cmds, err)
+	}
+	if _, formed, _ := cmds["noerr"].match([]byte("busy")); formed {
+		t.Fatalf("Without an Error source, unrelated bytes should not end the command")
+	}
+	if b, formed, err := cmds["noerr"].match([]byte("OK")); !formed || err != nil || string(b) != "OK" {
+		t.Fatalf("Without an Error source, Response should still match: %q %v", b, err)
+	}
+	if _, formed, _ := cmds["noresp"].match([]byte("busy")); formed {
+		t.Fatalf("Without a Response source, unrelated bytes should not end the command")
+	}
+	if b, err := cmds["noresp"].Bytes(); err != nil || string(b) != "GO\r" {
+		t.Fatalf("Without a CommandRegexp source, any formed command should do: %q %v", b, err)
+	}
+
+	_, err = CompileCommands(map[string]CommandSpec{
+		"bad": CommandSpec{CommandRegexp: ".*", Response: "OK", Error: "(unclosed"},
+	})
+	if err == nil {
+		t.Fatalf("Bad regexp should fail to compile")
+	}
+	if !strings.Contains(err.Error(), `"bad"`) || !strings.Contains(err.Error(), "Error") {
+		t.Fatalf("Error should name the command and field: %v", err)
+	}
+}
+
+func TestBuildCatalog(t *testing.T) {
+	type sensors struct {
+		Temp Command `name:"temp" prototype:"TEMP?\r" regexp:"TEMP\\?\r" response:"[0-9.]+\r" timeout:"500ms"`
+	}
+	type catalog struct {
+		Ping    Command `prototype:"\r" regexp:"\r" response:"\r" error:"a^" timeout:"1s" description:"keep alive"`
+		Sensors sensors
+		Other   string
+	}
+	var cat catalog
+	cmds, err := BuildCatalog(&cat)
+	if err != nil {
+		t.Fatalf("Valid tags should build: %v", err)
+	}
+	if len(cmds) != 2 || cmds["Ping"].Timeout != time.Second || cmds["Ping"].Description != "keep alive" {
+		t.Fatalf("Tagged commands not populated properly: %v", cmds)
+	}
+	if b, err := cmds["temp"].Bytes(); err != nil || string(b) != "TEMP?\r" || cmds["temp"].Timeout != 500*time.Millisecond {
+		t.Fatalf("Nested, named command should build: %q %v %v", b, err, cmds["temp"])
+	}
+	if cat.Sensors.Temp.Name != "temp" || cat.Ping.Response == nil {
+		t.Fatalf("Command fields should be set when given a pointer: %v", cat)
+	}
+
+	var bad struct {
+		Group struct {
+			Broken Command `prototype:"X" response:"(unclosed"`
+		}
+	}
+	if _, err := BuildCatalog(bad); err == nil || !strings.Contains(err.Error(), ".Group.Broken") || !strings.Contains(err.Error(), "Response") {
+		t.Fatalf("Error should name the field path and regexp: %v", err)
+	}
+	var slow struct {
+		Cmd Command `prototype:"X" timeout:"soon"`
+	}
+	if _, err := BuildCatalog(slow); err == nil || !strings.Contains(err.Error(), ".Cmd") {
+		t.Fatalf("Bad timeouts should be reported with the field path: %v", err)
+	}
+	if _, err := BuildCatalog(42); err == nil {
+		t.Fatalf("Non-structs should be rejected")
+	}
+}
+
+func TestDiffCommands(t *testing.T) {
+	a, _ := CompileCommands(map[string]CommandSpec{
+		"ping":  CommandSpec{Timeout: time.Second, Prototype: "\r", CommandRegexp: "\r", Response: "\r"},
+		"set":   CommandSpec{Timeout: time.Second, Prototype: "SET %02d\r", CommandRegexp: "SET [0-9]{2}\r", Response: "OK"},
+		"reset": CommandSpec{Timeout: time.Second, Prototype: "RST\r", CommandRegexp: "RST\r", Response: "OK"},
+	})
+	b, _ := CompileCommands(map[string]CommandSpec{
+		"ping": CommandSpec{Timeout: time.Second, Prototype: "\r", CommandRegexp: "\r", Response: "\r"},
+		"set":  CommandSpec{Timeout: time.Second, Prototype: "SET %02d\r", CommandRegexp: "SET [0-9]{2}\r", Response: "OK|DONE"},
+		"get":  CommandSpec{Timeout: time.Second, Prototype: "GET\r", CommandRegexp: "GET\r", Response: "[0-9]+"},
+		"zap":  CommandSpec{Timeout: time.Second, Prototype: "ZAP\r", CommandRegexp: "ZAP\r", Response: "OK"},
+	})
+	added, removed, changed := DiffCommands(a, b)
+	if strings.Join(added, ",") != "get,zap" || strings.Join(removed, ",") != "reset" || strings.Join(changed, ",") != "set" {
+		t.Fatalf("DiffCommands got added %v removed %v changed %v", added, removed, changed)
+	}
+
+	//separately compiled, but identical regexps are the same
+	if added, removed, changed = DiffCommands(a, a); len(added)+len(removed)+len(changed) != 0 {
+		t.Fatalf("A catalog should not differ from itself: %v %v %v", added, removed, changed)
+	}
+	c := Commands{"ping": a["ping"]}
+	c["ping"] = c["ping"].WithTimeout(2 * time.Second)
+	if _, _, changed = DiffCommands(a, c); strings.Join(changed, ",") != "ping" {
+		t.Fatalf("Changed timeout should be noticed: %v", changed)
+	}
+	c["ping"] = Command{Name: "ping", Timeout: time.Second, Prototype: "\r"}
+	if _, _, changed = DiffCommands(a, c); strings.Join(changed, ",") != "ping" {
+		t.Fatalf("nil regexps should differ from compiled ones: %v", changed)
+	}
+
+	legacy := a["ping"].WithTimeout(3 * time.Second)
+	x, y := a["ping"], a["ping"]
+	x.Fallback, y.Fallback = &legacy, &Command{}
+	*y.Fallback = legacy
+	if _, _, changed = DiffCommands(Commands{"ping": x}, Commands{"ping": y}); len(changed) != 0 {
+		t.Fatalf("Identical Fallbacks should be the same: %v", changed)
+	}
+	y.Fallback.Response = regexp.MustCompile("OK\r")
+	if _, _, changed = DiffCommands(Commands{"ping": x}, Commands{"ping": y}); strings.Join(changed, ",") != "ping" {
+		t.Fatalf("A Fallback with the same Prototype but a different Response should differ: %v", changed)
+	}
+	loop, loop2 := x, x //Fallback chains that loop back on themselves must not recurse forever
+	loop.Fallback, loop2.Fallback = &loop, &loop2
+	if _, _, changed = DiffCommands(Commands{"ping": loop}, Commands{"ping": loop2}); len(changed) != 0 {
+		t.Fatalf("A looping Fallback chain should be the same as itself: %v", changed)
+	}
+}
+
+func TestCommand_ReturnAll(t *testing.T) {
+	buf := []byte("line 1\r\nline 2\r\n> trailing")
+	c := Command{Response: regexp.MustCompile(`\r\n> `)}
+	if b, formed, err := c.match(buf); !formed || err != nil || string(b) != "\r\n> " {
+		t.Fatalf("By default only the match is returned: %q", b)
+	}
+	c.ReturnAll = true
+	if b, formed, err := c.match(buf); !formed || err != nil || string(b) != "line 1\r\nline 2\r\n> " {
+		t.Fatalf("ReturnAll should return everything up to the end of the match: %q", b)
+	}
+	c = Command{ResponseLiteral: "> ", ReturnAll: true}
+	if b, formed, err := c.match(buf); !formed || err != nil || string(b) != "line 1\r\nline 2\r\n> " {
+		t.Fatalf("ReturnAll should work with ResponseLiteral: %q", b)
+	}
+}
+
+func TestCatalogRegistry(t *testing.T) {
+	var reg CatalogRegistry
+	if _, err := reg.Lookup("X100"); !errors.Is(err, ErrUnknownModel) || !strings.Contains(err.Error(), `"X100"`) {
+		t.Fatalf("Empty registry should report the unknown model: %v", err)
+	}
+	x100 := Commands{"ping": pingOk}
+	x200 := Commands{"ping": pingOk, "reset": closeNice}
+	reg.Register("X100", x100)
+	reg.Register("X200", x200)
+	if cmds, err := reg.Lookup("X200"); err != nil || len(cmds) != 2 {
+		t.Fatalf("Should find the registered catalog: %v %v", cmds, err)
+	}
+	reg.Register("X200", x100)
+	if cmds, err := reg.Lookup("X200"); err != nil || len(cmds) != 1 {
+		t.Fatalf("Registering again should replace the catalog: %v %v", cmds, err)
+	}
+	if _, err := reg.Lookup("x100"); !errors.Is(err, ErrUnknownModel) {
+		t.Fatalf("Models are case sensitive: %v", err)
+	}
+}
+
+func TestCommand_TrimResponse(t *testing.T) {
+	c := Command{Response: regexp.MustCompile(`(?s)v.*`), Error: regexp.MustCompile("a^")}
+	tests := map[string]string{
+		"v1\r\n":   "v1",
+		"v1\n":     "v1",
+		"v1\r":     "v1",
+		"v1\r\n\n": "v1\r\n",
+		"v\r\n1":   "v\r\n1",
+		"v1":       "v1",
+	}
+	for in, want := range tests {
+		c.TrimResponse = false
+		if b, _, _ := c.match([]byte(in)); string(b) != in {
+			t.Errorf("Untrimmed reply should be left alone: %q != %q", b, in)
+		}
+		c.TrimResponse = true
+		if b, _, _ := c.match([]byte(in)); string(b) != want {
+			t.Errorf("Trimmed reply %q should be %q, got %q", in, want, b)
+		}
+	}
+}
+
+func TestResponse_Pretty(t *testing.T) {
+	resp := Response{Bytes: []byte("Temp: 21.5°C \"ok\"\r\n\x00\xff"), Error: ErrMatch, Duration: 1 * time.Second}
+	want := `Response> Rx Bytes: Temp: 21.5°C "ok"\r\n\x00\xff	Errors: Card returned error response	Duration: 1s`
+	if resp.Pretty() != want {
+		t.Fatalf("Response Pretty() func not working:\nGot : %s\nWant: %s", resp.Pretty(), want)
+	}
+}
+
+func TestResponse_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		resp Response
+		want string
+	}{
+		{Response{Bytes: []byte("OK\r"), Duration: 1500 * time.Millisecond},
+			`{"bytes":"OK\r","duration":"1.5s","first_byte_latency":"0s"}`},
+		{Response{Bytes: []byte{0x00, 0xff, 0xfe}, Error: ErrMatch, Duration: time.Second, FirstByteLatency: time.Millisecond},
+			`{"bytes":"AP/+","base64":true,"error":"Card returned error response","duration":"1s","first_byte_latency":"1ms"}`},
+		{Response{Bytes: []byte("OK"), ID: "req-42"},
+			`{"id":"req-42","bytes":"OK","duration":"0s","first_byte_latency":"0s"}`},
+		{Response{Bytes: []byte("OK"), Sent: []byte("SET 5\r")},
+			`{"bytes":"OK","duration":"0s","first_byte_latency":"0s","sent":"SET 5\r"}`},
+		{Response{Sent: []byte{0x02, 0xff}},
+			`{"bytes":"","duration":"0s","first_byte_latency":"0s","sent":"Av8=","sent_base64":true}`},
+	}
+	for _, test := range tests {
+		b, e := json.Marshal(test.resp)
+		if e != nil || string(b) != test.want {
+			t.Fatalf("MarshalJSON not working:\nGot : %s (%v)\nWant: %s", b, e, test.want)
+		}
+	}
+}
+
+func TestResponse_Equal(t *testing.T) {
+	base := Response{Bytes: []byte("OK\r"), Error: ErrTimeout, Duration: time.Second, ReadCount: 2}
+	tests := []struct {
+		other Response
+		want  bool
+	}{
+		{Response{Bytes: []byte("OK\r"), Error: ErrTimeout}, true},
+		{Response{Bytes: []byte("OK\r"), Error: fmt.Errorf("wrapped: %w", ErrTimeout), Duration: time.Minute}, true},
+		{Response{Bytes: []byte("OK\r"), Error: ErrBusy}, false},
+		{Response{Bytes: []byte("OK\r")}, false},
+		{Response{Bytes: []byte("NO\r"), Error: ErrTimeout}, false},
+	}
+	for i, test := range tests {
+		if base.Equal(test.other) != test.want || test.other.Equal(base) != test.want {
+			t.Errorf("%d: Equal(%v) should be %v", i, test.other, test.want)
+		}
+	}
+	if !(Response{}).Equal(Response{Bytes: []byte{}}) {
+		t.Errorf("Empty Responses should be Equal")
+	}
+}
+
+func TestCommand_mayMatch(t *testing.T) {
+	lens := map[string]int{
+		`END\r\n`:       5,
+		`(?i)ok`:        2 * utf8.UTFMax,
+		`ERR [0-9]{3}$`: 4 + 3*utf8.UTFMax,
+		`^(OK|FAIL)\b`:  4,
+		`> .*`:          -1,
+		`x+`:            -1,
+	}
+	for src, want := range lens {
+		if got := maxMatchLen(regexp.MustCompile(src)); got != want {
+			t.Errorf("maxMatchLen(%q) should be %d, got %d", src, want, got)
+		}
+	}
+	for i := 0; i < 2*reCacheSize; i++ {
+		maxMatchLen(regexp.MustCompile(fmt.Sprintf("seq=%d", i)))
+	}
+	if n := matchLen.len(); n > reCacheSize {
+		t.Errorf("maxMatchLen should not cache regexps without bound: %d", n)
+	}
+
+	c := Command{Response: regexp.MustCompile(`\bEND$`), Streaming: true}
+	old := strings.Repeat("x", 100)
+	if c.mayMatch([]byte(old+"END"), len(old)) {
+		t.Errorf("END without a word boundary before it should not match, even at the edge of the window")
+	}
+	if !c.mayMatch([]byte(old+" END"), len(old)) || !c.mayMatch([]byte(old+" EN"+"D"), len(old)+3) {
+		t.Errorf("A terminator arriving in, or finished by, the new bytes should match")
+	}
+	if c.mayMatch([]byte(" END"+old), 4+len(old)) {
+		t.Errorf("Only the new bytes and overlap should be searched")
+	}
+	c.Response = regexp.MustCompile(`END.*`)
+	if !c.mayMatch([]byte(" END"+old), 4+len(old)) {
+		t.Errorf("Unbounded regexps cannot be streamed, so should always be matched in full")
+	}
+}
+
+func TestCommand_ErrorCodeGroup(t *testing.T) {
+	c := Command{
+		Response:       regexp.MustCompile(`OK\r`),
+		Error:          regexp.MustCompile(`ERR (\d+|\w+)\r`),
+		ErrorCodeGroup: 1,
+	}
+	_, formed, err := c.match([]byte("ERR 42\r"))
+	var de DeviceError
+	if !formed || !errors.As(err, &de) || de.Code != 42 || string(de.Raw) != "ERR 42\r" || !errors.Is(err, ErrMatch) {
+		t.Fatalf("Error code should be parsed into a DeviceError: %v", err)
+	}
+	if _, _, err := c.match([]byte("ERR busy\r")); err != ErrMatch {
+		t.Fatalf("Non-numeric codes should fall back to ErrMatch: %v", err)
+	}
+	c.ErrorCodeGroup = 0
+	if _, _, err := c.match([]byte("ERR 42\r")); err != ErrMatch {
+		t.Fatalf("Without ErrorCodeGroup, Error matches should be ErrMatch: %v", err)
+	}
+}
+
+func TestCommand_With(t *testing.T) {
+	base := Command{
+		Name:          "base",
+		Timeout:       1 * time.Second,
+		Prototype:     "GET %d\r",
+		CommandRegexp: regexp.MustCompile(".*"),
+	}
+	slow := base.WithTimeout(5 * time.Second)
+	if slow.Timeout != 5*time.Second || base.Timeout != 1*time.Second {
+		t.Fatalf("WithTimeout should only change the copy: %v %v", slow, base)
+	}
+	alt := base.WithPrototype("GETX %d\r")
+	if alt.Prototype != "GETX %d\r" || base.Prototype != "GET %d\r" {
+		t.Fatalf("WithPrototype should only change the copy: %v %v", alt, base)
+	}
+	if alt.CommandRegexp != base.CommandRegexp || alt.Name != base.Name || alt.Timeout != base.Timeout {
+		t.Fatalf("Other fields should carry over: %v %v", alt, base)
+	}
+}
+
+func TestCommand_Framing(t *testing.T) {
+	c := Command{STX: 0x02, ETX: 0x03}
+	tests := []struct {
+		in     string
+		out    string
+		formed bool
+	}{
+		{"noise\x02payl", "", false},
+		{"noise\x02payload\x03trailer", "payload", true},
+		{"\x03\x02", "", false}, //ETX before STX is not a frame
+		{"\x02\x03", "", true},
+	}
+	for _, test := range tests {
+		if b, formed, err := c.match([]byte(test.in)); formed != test.formed || err != nil || string(b) != test.out {
+			t.Errorf("match(%q) = %q %v %v", test.in, b, formed, err)
+		}
+	}
+
+	c = Command{ETX: '\n', Error: regexp.MustCompile("ERR")}
+	if b, formed, _ := c.match([]byte("12.5\nmore")); !formed || string(b) != "12.5" {
+		t.Errorf("Without STX the payload is everything before ETX: %q", b)
+	}
+	if _, formed, err := c.match([]byte("ERR\n")); !formed || err != ErrMatch {
+		t.Errorf("Error should still be checked with framing: %v", err)
+	}
+}
+
+func TestCommand_DefaultArgs(t *testing.T) {
+	c := Command{
+		Name:          "set",
+		Prototype:     "SET %d @%s\r",
+		CommandRegexp: regexp.MustCompile(`^SET \d+ @U\d\r$`),
+		DefaultArgs:   []interface{}{nil, "U1"},
+	}
+	tests := []struct {
+		args []interface{}
+		out  string
+		err  error
+	}{
+		{[]interface{}{5}, "SET 5 @U1\r", nil},
+		{[]interface{}{5, "U2"}, "SET 5 @U2\r", nil}, //explicit args win
+		{[]interface{}{}, "", ErrBytesArgs},          //the nil default is no good as a %d
+		{[]interface{}{5, "U2", 3}, "", ErrBytesArgs},
+	}
+	for _, test := range tests {
+		if b, err := c.Bytes(test.args...); err != test.err || (err == nil && string(b) != test.out) {
+			t.Errorf("Bytes(%v) = %q %v", test.args, b, err)
+		}
+	}
+}
+
+func TestCommand_CoerceArgs(t *testing.T) {
+	c := Command{Name: "set", Prototype: "SET %02d %.1f %t %s %*d%%\r", CommandRegexp: regexp.MustCompile(`^SET `), CoerceArgs: true}
+	tests := []struct {
+		args []interface{}
+		out  string
+		bad  string
+	}{
+		{[]interface{}{"7", "2.25", "true", "x", "3", "0x10"}, "SET 07 2.2 true x  16%\r", ""},
+		{[]interface{}{7, 2.5, false, "y", 1, 9}, "SET 07 2.5 false y 9%\r", ""}, //typed args pass through
+		{[]interface{}{" 8 ", "1", "0", "z", "2", "5"}, "SET 08 1.0 false z  5%\r", ""},
+		{[]interface{}{"seven", "1", "true", "x", "1", "1"}, "", `arg 0 "seven" is not a valid integer for %d`},
+		{[]interface{}{"1", "1.2.3", "true", "x", "1", "1"}, "", `arg 1 "1.2.3" is not a valid float for %f`},
+		{[]interface{}{"1", "1", "maybe", "x", "1", "1"}, "", `arg 2 "maybe" is not a valid bool for %t`},
+		{[]interface{}{"1", "1", "true", "x", "wide", "1"}, "", `arg 4 "wide" is not a valid integer for %*`},
+	}
+	for _, test := range tests {
+		b, err := c.Bytes(test.args...)
+		if test.bad == "" && (err != nil || string(b) != test.out) {
+			t.Errorf("Bytes(%v) = %q %v", test.args, b, err)
+		}
+		if test.bad != "" && (!errors.Is(err, ErrBytesArgs) || !strings.Contains(err.Error(), test.bad)) {
+			t.Errorf("Bytes(%v) should fail with %q: %v", test.args, test.bad, err)
+		}
+	}
+	c.CoerceArgs = false
+	if _, err := c.Bytes("7", "2.25", "true", "x", "3", "16"); err != ErrBytesArgs {
+		t.Errorf("Without CoerceArgs string args should not fit %%d: %v", err)
+	}
+}
+
+func TestCommand_ValidateArgs(t *testing.T) {
+	errPort := errors.New("Port must be 1..48")
+	c := Command{
+		Name:          "enable",
+		Prototype:     "ENABLE %d\r",
+		CommandRegexp: regexp.MustCompile(`^ENABLE \d+\r$`),
+		CoerceArgs:    true,
+		ValidateArgs: func(args []interface{}) error {
+			if n, ok := args[0].(int64); !ok || n < 1 || n > 48 {
+				return errPort
+			}
+			return nil
+		},
+	}
+	if b, err := c.Bytes("12"); err != nil || string(b) != "ENABLE 12\r" {
+		t.Errorf("Valid args should be formatted: %q %v", b, err)
+	}
+	_, err := c.Bytes("49")
+	if !errors.Is(err, ErrBytesArgs) || !errors.Is(err, errPort) || !strings.Contains(err.Error(), "1..48") {
+		t.Errorf("Args failing ValidateArgs should fail Bytes with the reason: %v", err)
+	}
+}
+
+func TestCommand_LengthPrefix(t *testing.T) {
+	tests := []struct {
+		prefix LengthPrefix
+		in     string
+		out    string
+		formed bool
+	}{
+		{LengthPrefix{Size: 2}, "\x00", "", false},
+		{LengthPrefix{Size: 2}, "\x00\x05hel", "", false},
+		{LengthPrefix{Size: 2}, "\x00\x05hello", "hello", true},
+		{LengthPrefix{Size: 2}, "\x00\x05hello, again", "hello", true},
+		{LengthPrefix{Size: 2}, "\x00\x00", "", true},
+		{LengthPrefix{Size: 2, LittleEndian: true}, "\x05\x00hello", "hello", true},
+		{LengthPrefix{Size: 4}, "\x00\x00\x01\x00short", "", false},
+		{LengthPrefix{Size: 4, LittleEndian: true}, "\x03\x00\x00\x00abcd", "abc", true},
+	}
+	for _, test := range tests {
+		c := Command{LengthPrefix: test.prefix}
+		if b, formed, err := c.match([]byte(test.in)); formed != test.formed || err != nil || string(b) != test.out {
+			t.Errorf("match(%q) with %+v = %q %v %v", test.in, test.prefix, b, formed, err)
+		}
+	}
+	for _, c := range []Command{{LengthPrefix: LengthPrefix{Size: 3}}, {LengthPrefix: LengthPrefix{Size: -1}}, {LengthPrefix: LengthPrefix{Size: 9}}, {Codec: LengthPrefix{}}} {
+		if _, formed, err := c.match([]byte("\x00\x00\x00\x00\x00\x00\x00\x00\x00\x05hello")); !formed || !errors.Is(err, ErrLengthPrefix) {
+			t.Errorf("%+v should fail match with ErrLengthPrefix: %v %v", c.codec(), formed, err)
+		}
+		if _, err := c.Bytes(); !errors.Is(err, ErrLengthPrefix) {
+			t.Errorf("%+v should fail Bytes with ErrLengthPrefix: %v", c.codec(), err)
+		}
+	}
+}
+
+func TestCommand_Decompress(t *testing.T) {
+	payload := "line 1\nline 2\nline 3\n"
+	var gz, zl bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(payload))
+	w.Close()
+	z := zlib.NewWriter(&zl)
+	z.Write([]byte(payload))
+	z.Close()
+	framed := func(b []byte) []byte { //2 byte big-endian length header
+		return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+	}
+
+	c := Command{LengthPrefix: LengthPrefix{Size: 2}, Decompress: CompressGzip}
+	if b, formed, err := c.match(framed(gz.Bytes())); !formed || err != nil || string(b) != payload {
+		t.Fatalf("gzip reply should be decompressed: %q %v %v", b, formed, err)
+	}
+	c.Decompress = CompressZlib
+	if b, formed, err := c.match(framed(zl.Bytes())); !formed || err != nil || string(b) != payload {
+		t.Fatalf("zlib reply should be decompressed: %q %v %v", b, formed, err)
+	}
+	if _, formed, err := c.match(framed(gz.Bytes())); !formed || !errors.Is(err, ErrDecompress) {
+		t.Fatalf("Undecompressable reply should fail with ErrDecompress: %v %v", formed, err)
+	}
+	c.Decompress = CompressGzip
+	if _, formed, err := c.match(framed(gz.Bytes()[:gz.Len()-4])); !formed || !errors.Is(err, ErrDecompress) {
+		t.Fatalf("Truncated reply should fail with ErrDecompress: %v %v", formed, err)
+	}
+	c.MaxResponseBytes = len(payload)
+	if b, _, err := c.match(framed(gz.Bytes())); err != nil || string(b) != payload {
+		t.Fatalf("A reply decompressing to MaxResponseBytes should be fine: %q %v", b, err)
+	}
+	c.MaxResponseBytes--
+	if _, formed, err := c.match(framed(gz.Bytes())); !formed || !errors.Is(err, ErrDecompress) || !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("A reply decompressing past MaxResponseBytes should fail: %v %v", formed, err)
+	}
+	defer func(max int) { MaxDecompressed = max }(MaxDecompressed)
+	c.MaxResponseBytes, MaxDecompressed = 0, 8
+	if _, formed, err := c.match(framed(gz.Bytes())); !formed || !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("Without MaxResponseBytes, MaxDecompressed should bound the reply: %v %v", formed, err)
+	}
+}
+
+func TestCommand_Trailer(t *testing.T) {
+	tests := []struct {
+		c      Command
+		in     string
+		out    string
+		formed bool
+		bare   string //the reply once time is up waiting on the Trailer
+	}{
+		{Command{Response: regexp.MustCompile(`[0-9.]+\r\n`)}, "12.5\r\n", "12.5\r\n", false, "12.5\r\n"},
+		{Command{Response: regexp.MustCompile(`[0-9.]+\r\n`)}, "12.5\r\n> ", "12.5\r\n", true, "12.5\r\n"},
+		{Command{Response: regexp.MustCompile(`[0-9.]+\r\n`), ReturnAll: true}, "> 12.5\r\n> ", "> 12.5\r\n", true, "> 12.5\r\n"},
+		{Command{ResponseLiteral: "OK"}, "OK> ", "OK", true, "OK"},
+		{Command{STX: 0x02, ETX: 0x03}, "\x02> \x03", "", false, "> "}, //the prompt inside the frame is not the trailer
+		{Command{STX: 0x02, ETX: 0x03}, "\x02> \x03> ", "> ", true, "> "},
+		{Command{LengthPrefix: LengthPrefix{Size: 1}}, "\x02> > ", "> ", true, "> "},
+	}
+	for _, test := range tests {
+		test.c.Trailer = regexp.MustCompile("^> $")
+		if b, formed, err := test.c.match([]byte(test.in)); formed != test.formed || err != nil || (formed && string(b) != test.out) {
+			t.Errorf("match(%q) = %q %v %v", test.in, b, formed, err)
+		}
+		if b, ok := test.c.untrailed([]byte(test.in)); !ok || string(b) != test.bare {
+			t.Errorf("untrailed(%q) = %q %v, want the reply without waiting on the Trailer", test.in, b, ok)
+		}
+	}
+	if _, ok := (Command{Response: regexp.MustCompile(`OK`)}).untrailed([]byte("OK")); ok {
+		t.Errorf("untrailed is only for Commands with a Trailer")
+	}
+}
+
+func TestCommand_AnchorEnd(t *testing.T) {
+	re := Command{Response: regexp.MustCompile(`OK\r`), Error: regexp.MustCompile(`ERR\r`), AnchorEnd: true}
+	lit := Command{ResponseLiteral: "OK\r", ErrorLiteral: "ERR\r", AnchorEnd: true}
+	tests := []struct {
+		in     string
+		out    string
+		formed bool
+		err    error
+	}{
+		{"OK\rstill talking", "", false, nil},
+		{"ERR\rstill talking", "", false, nil},
+		{"status OK\r", "OK\r", true, nil},
+		{"OK\rERR\r", "OK\rERR\r", true, ErrMatch},
+		{"ERR\rOK\r", "OK\r", true, nil},
+	}
+	for _, c := range []Command{re, lit} {
+		for _, test := range tests {
+			b, formed, err := c.match([]byte(test.in))
+			if formed != test.formed || err != test.err || (formed && string(b) != test.out) {
+				t.Errorf("%q match(%q) = %q %v %v", c.ResponseLiteral, test.in, b, formed, err)
+			}
+		}
+	}
+	c := Command{Response: regexp.MustCompile(`[0-9]+\r`), ReturnAll: true, AnchorEnd: true}
+	if b, formed, _ := c.match([]byte("1\r2\r3\r")); !formed || string(b) != "1\r2\r3\r" {
+		t.Errorf("ReturnAll should return up to the match at the end: %q", b)
+	}
+	c.ReturnAll = false
+	if b, formed, _ := c.match([]byte("1\r2\r3\r")); !formed || string(b) != "3\r" {
+		t.Errorf("Only the match at the end should be returned: %q", b)
+	}
+
+	longest := regexp.MustCompile(`[0-9]+\r`)
+	longest.Longest()
+	if c.anchor(c.Response) == c.anchor(longest) {
+		t.Errorf("Regexps with the same source should not share an anchored form")
+	}
+	deep := strings.Repeat("(", 999) + "x" + strings.Repeat(")", 999) //as deep as regexp allows
+	c = Command{Response: regexp.MustCompile(deep), AnchorEnd: true}
+	if _, formed, err := c.match([]byte("x")); !formed || err == nil {
+		t.Errorf("A regexp that cannot be anchored should fail the command, not panic: %v %v", formed, err)
+	}
+}
+
+func TestCommand_ResponseFuncCaches(t *testing.T) {
+	c := Command{
+		Prototype:     "GET %d\r",
+		CommandRegexp: regexp.MustCompile(`^GET \d+\r$`),
+		AnchorEnd:     true,
+		Streaming:     true,
+		ResponseFunc: func(args []interface{}) *regexp.Regexp {
+			return regexp.MustCompile(fmt.Sprintf(`REPLY:%d\r`, args[0]))
+		},
+	}
+	for seq := 0; seq < 2*reCacheSize; seq++ {
+		bound := c.bind([]interface{}{seq})
+		reply := []byte(fmt.Sprintf("REPLY:%d\r", seq))
+		if !bound.mayMatch(reply, 0) {
+			t.Fatalf("Reply %d should be worth matching", seq)
+		}
+		if b, formed, err := bound.match(reply); !formed || err != nil || !bytes.Equal(b, reply) {
+			t.Fatalf("Reply %d should match: %q %v", seq, b, err)
+		}
+	}
+	if a, m := anchoredRe.len(), matchLen.len(); a > reCacheSize || m > reCacheSize {
+		t.Fatalf("A pattern per call should not grow the caches without bound: %d %d", a, m)
+	}
+}
+
+func TestReCache(t *testing.T) {
+	var c reCache[int]
+	calls := 0
+	calc := func(re *regexp.Regexp) int {
+		calls++
+		return len(re.String())
+	}
+	hot := regexp.MustCompile("hot")
+	for i := 0; i < 3*reCacheSize; i++ {
+		c.get(hot, calc)
+		c.get(regexp.MustCompile(fmt.Sprintf("seq=%d", i)), calc) //made per call, as by ResponseFunc
+	}
+	if n := c.len(); n != reCacheSize {
+		t.Fatalf("Cache should stay bounded at %d, has %d", reCacheSize, n)
+	}
+	calls = 0
+	if v := c.get(hot, calc); v != 3 || calls != 0 {
+		t.Fatalf("Recently used regexps should stay cached: %d after %d calls", v, calls)
+	}
+}
+
+func TestCommand_Encoding(t *testing.T) {
+	c := Command{Response: regexp.MustCompile(`(?s)T=.*\r`), TrimResponse: true, Encoding: charmap.ISO8859_1}
+	if b, formed, err := c.match([]byte("T=21.5\xb0C\r")); !formed || err != nil || string(b) != "T=21.5°C" {
+		t.Fatalf("latin-1 reply should be transcoded to UTF-8: %q %v", b, err)
+	}
+
+	c = Command{LengthPrefix: LengthPrefix{Size: 1}, Encoding: unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)}
+	if b, formed, err := c.match([]byte("\x06\x00O\x00K\x00\xb0")); !formed || err != nil || string(b) != "OK°" {
+		t.Fatalf("UTF-16 reply should be transcoded to UTF-8: %q %v", b, err)
+	}
+	if _, formed, err := c.match([]byte("\x03\x00O\x00")); !formed || !errors.Is(err, ErrDecode) {
+		t.Fatalf("Odd length UTF-16 should fail with ErrDecode: %v", err)
+	}
+	if _, formed, err := c.match([]byte("\x02\xd8\x00")); !formed || !errors.Is(err, ErrDecode) {
+		t.Fatalf("Unpaired surrogate should fail with ErrDecode: %v", err)
+	}
+}
+
+func TestCommand_BytesVerbatim(t *testing.T) {
+	c := Command{
+		Name:          "nonce",
+		Prototype:     "AUTH %v %s\r",
+		CommandRegexp: regexp.MustCompile(`(?s)^AUTH .{4} [a-z]+\r$`),
+	}
+	nonce := []byte{0x00, '%', '!', 0xff}
+	b, err := c.Bytes(nonce, "admin")
+	if err != nil {
+		t.Fatalf("[]byte arg should be spliced in: %v", err)
+	}
+	if want := append(append([]byte("AUTH "), nonce...), []byte(" admin\r")...); !bytes.Equal(b, want) {
+		t.Fatalf("[]byte arg not inserted verbatim: %q != %q", b, want)
+	}
+	if _, err := c.Bytes(nonce); err != ErrBytesArgs {
+		t.Fatalf("Missing args should still be caught: %v", err)
+	}
+	if _, err := c.Bytes([]byte("toolong"), "admin"); err != ErrBytesFormat {
+		t.Fatalf("CommandRegexp should validate the assembled bytes: %v", err)
+	}
+}
@@ -34,6 +34,53 @@ The basic Arbiter interface requires only 3 functions:
 	Dial - Opens initial connect over stream and verifies the connection is active via ping
 	Control - Sends a command verb and waits for response, timeout, or error
 
+Arbiters from this package offer more besides, grouped into optional interfaces that callers type
+assert for, such as a.(arbiter.Monitor).  Controller has more ways to issue a command:
+
+	ControlContext - Like Control, but also bounded by a context.Context
+	ControlDeadline - Like Control, but with an absolute deadline in place of the Timeout
+	ControlID - Like Control, but tags the Response with a correlation ID
+	ControlAsync - Like Control, but returns immediately and hands the Response to a callback
+	ControlProgress - Like Control, but also reports each piece of the reply as it arrives
+	TryControl - Like Control, but skips the command if the Arbiter is busy
+
+Configurer tunes connection setup and the wire:
+
+	DialWithResult - Like Dial, but also describes how the connection came up
+	SetWarmup - Issues fixed setup commands after each successful Dial
+	SetOnConnect - Runs session setup, such as a login, after each successful Dial
+	SetPreamble - Sends a fixed byte sequence ahead of every command
+	SetWireCodec - Transforms all traffic, such as base64 for text only channels
+	SetMaxLifetime - Closes the connection a fixed time after each successful Dial
+	SetNoDelay - Enables or disables TCP_NODELAY (on by default) where it applies
+	SetInterByteDelay - Writes requests a byte at a time, for devices that drop characters
+	SetFallbackDelay - Tunes racing IPv4 against IPv6 when dialing dual stack hosts
+	SetExpectProxyHeader - Reads a PROXY protocol header on connect, as sent by some load balancers
+	RemoteAddr - Returns the address of the peer, as given by any PROXY protocol header
+
+Governor limits, holds back, or drains commands:
+
+	CloseGraceful - Like Close, but lets already queued commands finish first
+	SetMaxQueue / QueueLen - Bound and monitor the number of commands waiting their turn
+	WaitIdle - Waits for the command in flight, if any, to finish
+	SetCircuitBreaker - Fails commands fast while a device keeps failing
+	CacheClear - Drops cached Responses of commands with a CacheTTL
+	Pause / Resume - Temporarily reject commands with ErrPaused without dropping the connection
+	SetDryRun - Forms and validates commands without sending them
+
+Monitor reports on the connection and its traffic:
+
+	Done - Returns a channel closed once the connection is finished with
+	LastError - Returns the error that broke the connection, if any
+	StalledFor - Reports how long the command in flight has gone without receiving anything
+	Snapshot - Gathers connection state, errors, and counters for admin endpoints
+	BytesRead / BytesWritten - Total traffic over every connection the Arbiter has made
+	SetStateObserver - Reports internal state transitions, for debugging
+	Probe - Re-sends the Dial ping command, returning its round trip time
+	Tap / Untap - Mirror raw wire traffic to an io.Writer
+	SetTranscript / Transcript - Keep recent wire traffic in memory, and retrieve it
+	Capabilities - Reports what the transport supports
+
 Command Structure
 
 As the purpose of this package is to provide a command and control structure around a stream,
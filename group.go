@@ -0,0 +1,53 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"sync"
+)
+
+//Group is a set of Arbiters, typically identical devices, keyed by the address they were Dialed on
+type Group map[string]Arbiter
+
+/*Broadcast issues cmd with args to every member of the Group concurrently and waits for all of them to
+finish.  The returned map holds each member's Response under the same key as the Group.  A failing
+member does not affect the others; its error is only reported in its own Response.Error*/
+func (g Group) Broadcast(cmd Command, args ...interface{}) map[string]Response {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	rtn := make(map[string]Response, len(g))
+	for addr, a := range g {
+		wg.Add(1)
+		go func(addr string, a Arbiter) {
+			defer wg.Done()
+			resp := a.Control(cmd, args...)
+			mu.Lock()
+			rtn[addr] = resp
+			mu.Unlock()
+		}(addr, a)
+	}
+	wg.Wait()
+	return rtn
+}
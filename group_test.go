@@ -0,0 +1,60 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroup_Broadcast(t *testing.T) {
+	g := Group{}
+	for i := 0; i < 3; i++ {
+		a := New("tcp")
+		if e := a.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Need initial connection to be setup, and couldnt setup")
+		}
+		defer a.Close()
+		g[string(rune('a'+i))] = a
+	}
+	g["dead"] = New("tcp") //never dialed
+
+	resps := g.Broadcast(pingOk)
+	if len(resps) != len(g) {
+		t.Fatalf("Should get a response from every member: %v", resps)
+	}
+	for addr, resp := range resps {
+		switch addr {
+		case "dead":
+			if resp.Error != ErrNotConnected {
+				t.Errorf("Undialed member should report ErrNotConnected: %v", resp)
+			}
+		default:
+			if resp.Error != nil {
+				t.Errorf("Member %q should succeed: %v", addr, resp)
+			}
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+//ErrMuxTag is returned by Mux.Arbiter for a tag that already has a logical Arbiter
+var ErrMuxTag = errors.New("Mux tag already in use")
+
+/*Mux shares one connection between logical Arbiters, for gateways that multiplex many device sessions
+over one socket by tagging each message with its session.  Everything a logical Arbiter sends goes out as
+its tag, then the separator, then the request as formed.  Incoming lines, of the form tag, separator,
+reply, delimiter, are handed to the logical Arbiter with that tag as the reply and delimiter, and lines
+for tags without one are dropped.
+
+Each logical Arbiter is an ordinary Arbiter running over its own end of the Mux, as from NewConn, so Dial
+must still be called on it and all of Command and Response work as usual.  Closing one leaves the others
+be, while the shared connection failing or the Mux being closed Closes them all*/
+type Mux struct {
+	conn  net.Conn           //shared connection to the gateway
+	sep   []byte             //between the tag and the message
+	delim []byte             //ends each incoming line
+	wmu   sync.Mutex         //serializes writes to conn, so tagged requests are never interleaved
+	mu    sync.Mutex         //guards ends and err
+	ends  map[string]*muxEnd //logical Arbiters by tag
+	err   error              //why the Mux is finished with, nil until then
+}
+
+//muxEnd is the Mux's end of one logical Arbiter's connection
+type muxEnd struct {
+	arb    Arbiter       //the logical Arbiter handed out
+	dev    net.Conn      //the Mux's end of the pipe, the logical Arbiter holds the other
+	mu     sync.Mutex    //guards queue
+	queue  [][]byte      //replies waiting to be handed over
+	ready  chan bool     //signalled when queue grows
+	closed chan struct{} //closed once the logical connection is finished with
+	once   sync.Once     //closes closed
+}
+
+/*NewMux starts demultiplexing conn, an established connection to the gateway.  sep separates the tag from
+the message, ":" if empty, and delim ends each incoming line, "\n" if empty.  Tags must not contain sep*/
+func NewMux(conn net.Conn, sep, delim string) *Mux {
+	if sep == "" {
+		sep = ":"
+	}
+	if delim == "" {
+		delim = "\n"
+	}
+	m := &Mux{conn: conn, sep: []byte(sep), delim: []byte(delim), ends: map[string]*muxEnd{}}
+	go m.demux()
+	return m
+}
+
+/*Arbiter returns a new logical Arbiter for tag.  It fails with ErrMuxTag if tag is already in use, until
+the Arbiter using it is Closed, and with ErrNotConnected once the Mux is finished with*/
+func (m *Mux) Arbiter(tag string) (Arbiter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotConnected, m.err)
+	}
+	if _, ok := m.ends[tag]; ok {
+		return nil, fmt.Errorf("%w: %q", ErrMuxTag, tag)
+	}
+	client, dev := net.Pipe()
+	e := &muxEnd{arb: NewConn(client), dev: dev, ready: make(chan bool, 1), closed: make(chan struct{})}
+	m.ends[tag] = e
+	go m.upstream(tag, e)
+	go e.pump()
+	return e.arb, nil
+}
+
+//Close closes the shared connection, and Closes every logical Arbiter still using it
+func (m *Mux) Close() error {
+	m.stop(net.ErrClosed)
+	return m.conn.Close()
+}
+
+//stop finishes the Mux with why, closing every logical connection and Closing its Arbiter
+func (m *Mux) stop(why error) {
+	m.mu.Lock()
+	if m.err == nil {
+		m.err = why
+	}
+	ends := m.ends
+	m.ends = map[string]*muxEnd{}
+	m.mu.Unlock()
+	for _, e := range ends {
+		e.close()
+		e.arb.Close()
+	}
+}
+
+//demux reads the shared connection, handing each line to the logical Arbiter its tag names
+func (m *Mux) demux() {
+	var buf []byte
+	chunk := make([]byte, 4096)
+	for {
+		n, err := m.conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		for i := bytes.Index(buf, m.delim); i >= 0; i = bytes.Index(buf, m.delim) {
+			line := buf[:i+len(m.delim)]
+			buf = buf[i+len(m.delim):]
+			if tag, reply, ok := bytes.Cut(line, m.sep); ok {
+				m.mu.Lock()
+				e := m.ends[string(tag)]
+				m.mu.Unlock()
+				if e != nil {
+					e.put(append([]byte(nil), reply...))
+				}
+			}
+		}
+		if err != nil {
+			m.stop(err)
+			m.conn.Close()
+			return
+		}
+	}
+}
+
+//upstream tags everything the logical Arbiter for tag sends, and writes it to the shared connection
+func (m *Mux) upstream(tag string, e *muxEnd) {
+	buf := make([]byte, 64*1024) //large enough that a request is never split
+	for {
+		n, err := e.dev.Read(buf)
+		if err != nil { //the logical Arbiter closed, free up its tag
+			m.mu.Lock()
+			if m.ends[tag] == e {
+				delete(m.ends, tag)
+			}
+			m.mu.Unlock()
+			e.close()
+			return
+		}
+		out := append(append([]byte(tag), m.sep...), buf[:n]...)
+		m.wmu.Lock()
+		_, err = m.conn.Write(out)
+		m.wmu.Unlock()
+		if err != nil {
+			m.stop(err)
+			m.conn.Close()
+			return
+		}
+	}
+}
+
+//put queues a reply for the logical Arbiter, without waiting on it to read
+func (e *muxEnd) put(b []byte) {
+	e.mu.Lock()
+	e.queue = append(e.queue, b)
+	e.mu.Unlock()
+	select {
+	case e.ready <- true:
+	default: //already signalled
+	}
+}
+
+//pump hands queued replies to the logical Arbiter, so one slow reader cannot hold up the others
+func (e *muxEnd) pump() {
+	for {
+		select {
+		case <-e.ready:
+		case <-e.closed:
+			return
+		}
+		e.mu.Lock()
+		q := e.queue
+		e.queue = nil
+		e.mu.Unlock()
+		for _, b := range q {
+			if _, err := e.dev.Write(b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+//close ends the logical connection, which the logical Arbiter sees as the peer hanging up
+func (e *muxEnd) close() {
+	e.once.Do(func() {
+		close(e.closed)
+		e.dev.Close()
+	})
+}
@@ -0,0 +1,137 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//muxGateway echoes each tagged line back, after a line for a tag nobody uses
+func muxGateway(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "nobody:%s", line[strings.Index(line, ":")+1:])
+		conn.Write([]byte(line))
+	}
+}
+
+func TestMux(t *testing.T) {
+	client, server := net.Pipe()
+	go muxGateway(server)
+	m := NewMux(client, "", "")
+	defer m.Close()
+	echo := Command{
+		Name:          "echo",
+		Timeout:       time.Second,
+		Prototype:     "ECHO %s\n",
+		CommandRegexp: regexp.MustCompile(`^ECHO \w+\n$`),
+		Response:      regexp.MustCompile(`ECHO \w+\n`),
+	}
+	ping := echo
+	ping.Prototype = "ECHO ping\n"
+
+	var wg sync.WaitGroup
+	for _, tag := range []string{"a", "b", "c"} {
+		a, err := m.Arbiter(tag)
+		if err != nil {
+			t.Fatalf("Arbiter(%q) failed: %v", tag, err)
+		}
+		defer a.Close()
+		if e := a.Dial("", time.Second, ping); e != nil {
+			t.Fatalf("Logical Arbiter %q should Dial over the Mux: %v", tag, e)
+		}
+		wg.Add(1)
+		go func(tag string, a Arbiter) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				want := fmt.Sprintf("ECHO %s%d\n", tag, i)
+				if resp := a.Control(echo, fmt.Sprintf("%s%d", tag, i)); resp.Error != nil || string(resp.Bytes) != want {
+					t.Errorf("Logical Arbiter %q should only see its own replies: got %v, want %q", tag, resp, want)
+					return
+				}
+			}
+		}(tag, a)
+	}
+	wg.Wait()
+
+	if _, err := m.Arbiter("a"); !errors.Is(err, ErrMuxTag) {
+		t.Errorf("A tag in use should not be handed out twice: %v", err)
+	}
+	a, _ := m.Arbiter("d")
+	if e := a.Dial("", time.Second, ping); e != nil {
+		t.Fatalf("Logical Arbiter should Dial over the Mux: %v", e)
+	}
+	a.Close()
+	time.Sleep(10 * time.Millisecond) //let the Mux see it go
+	if _, err := m.Arbiter("d"); err != nil {
+		t.Errorf("Closing a logical Arbiter should free its tag: %v", err)
+	}
+
+	m.Close()
+	if _, err := m.Arbiter("e"); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("A closed Mux should not hand out Arbiters: %v", err)
+	}
+}
+
+func TestMux_Shared(t *testing.T) {
+	client, server := net.Pipe()
+	go muxGateway(server)
+	m := NewMux(client, "", "")
+	defer m.Close()
+	ping := Command{
+		Name:          "ping",
+		Timeout:       time.Second,
+		Prototype:     "PING\n",
+		CommandRegexp: regexp.MustCompile(`^PING\n$`),
+		Response:      regexp.MustCompile(`PING\n`),
+	}
+	a, _ := m.Arbiter("a")
+	defer a.Close()
+	if e := a.Dial("", time.Second, ping); e != nil {
+		t.Fatalf("Logical Arbiter should Dial over the Mux: %v", e)
+	}
+	server.Close() //the gateway goes away
+	select {
+	case <-a.(Monitor).Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Losing the shared connection should end every logical Arbiter")
+	}
+	if resp := a.Control(ping); resp.Error == nil {
+		t.Errorf("Control should fail once the shared connection is gone")
+	}
+}
@@ -0,0 +1,124 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//ProxyListenTimeout is how long Proxy waits for a command from the front Arbiter before checking again
+var ProxyListenTimeout = 1 * time.Second
+
+//ErrProxyCommands is returned by Proxy when it is not given commands it can recognise
+var ErrProxyCommands = errors.New("Proxy needs commands to relay")
+
+//proxyMaxPending bounds what Proxy holds onto from the front Arbiter while no command matches
+const proxyMaxPending = 64 * 1024
+
+var (
+	proxyAny   = regexp.MustCompile("(?s).*") //any bytes at all
+	proxyNow   = regexp.MustCompile("")       //matches immediately
+	proxyNever = regexp.MustCompile("a^")     //never matches
+)
+
+/*Proxy relays commands between two Arbiters.  Bytes arriving on front that match the CommandRegexp of
+any of cmds are forwarded to back as that command, and whatever back replies with (on success or an
+Error match) is written back out on front.  Proxy runs until either Arbiter returns an error other than
+ErrTimeout or ErrMatch, typically because one side closed, and returns that error.  It fails straight
+away with ErrProxyCommands if cmds is empty, or any of them has no CommandRegexp or one matching nothing
+at all.
+
+Since front is polled with a Command that sends nothing and waits for the commands, CommandRegexps should
+not be anchored with ^ or $.  What arrives on front is kept until it makes up a command, even across
+ProxyListenTimeout, so a command split over several reads is still relayed, as is one that arrived along
+with the one before it.  Up to 64KiB that matches no command is kept, the oldest dropped first.  Bytes that
+arrive on front while a command is being relayed are dropped, so the client on the front side should wait
+for each reply before sending the next command*/
+func Proxy(front, back Arbiter, cmds Commands) error {
+	if len(cmds) == 0 {
+		return fmt.Errorf("%w: none given", ErrProxyCommands)
+	}
+	var alts []string
+	for name, cmd := range cmds {
+		if cmd.CommandRegexp == nil || cmd.CommandRegexp.MatchString("") {
+			return fmt.Errorf("%w: %q needs a CommandRegexp that matches something", ErrProxyCommands, name)
+		}
+		alts = append(alts, "(?:"+cmd.CommandRegexp.String()+")")
+	}
+	listen := Command{
+		Name:          "proxy-listen",
+		Timeout:       ProxyListenTimeout,
+		CommandRegexp: proxyNow,
+		Response:      regexp.MustCompile(strings.Join(alts, "|")),
+		Error:         proxyNever,
+		Extract:       func(re *regexp.Regexp, buf []byte) []byte { return buf }, //all of it, for pending
+	}
+
+	var pending []byte //off front but not yet relayed
+	for {
+		loc := listen.Response.FindIndex(pending)
+		if loc == nil {
+			req := front.Control(listen)
+			switch err := req.Error; {
+			case err == nil || errors.Is(err, ErrTimeout): //a timeout may still have brought part of a command
+			default:
+				return err
+			}
+			pending = append(pending, req.Bytes...)
+			if n := len(pending) - proxyMaxPending; n > 0 {
+				pending = pending[n:]
+			}
+			continue
+		}
+		in := append([]byte(nil), pending[loc[0]:loc[1]]...)
+		pending = pending[loc[1]:]
+
+		var fwd Command
+		for _, cmd := range cmds {
+			if cmd.CommandRegexp.Match(in) {
+				fwd = cmd
+				break
+			}
+		}
+		fwd.Prototype = "%s"
+		resp := back.Control(fwd, string(in))
+		switch err := resp.Error; {
+		case err == nil || errors.Is(err, ErrMatch): //a DeviceError is an Error match too
+		case errors.Is(err, ErrTimeout): //nothing to relay, let the front side time out on its own
+			continue
+		default:
+			return err
+		}
+
+		relay := Command{Name: "proxy-relay", Timeout: fwd.Timeout, Prototype: "%s", CommandRegexp: proxyAny, Response: proxyNow, Error: proxyNever}
+		if r := front.Control(relay, string(resp.Bytes)); r.Error != nil {
+			return r.Error
+		}
+	}
+}
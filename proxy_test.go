@@ -0,0 +1,176 @@
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+//proxyCmds is what the Proxy tests relay
+var proxyCmds = Commands{
+	"get": Command{
+		Name:          "get",
+		Timeout:       200 * time.Millisecond,
+		Prototype:     "GET %02d\r",
+		CommandRegexp: regexp.MustCompile("GET [0-9]{2}\r"),
+		Response:      regexp.MustCompile("GET [0-9]{2}\r"), //simulator echos
+		Error:         regexp.MustCompile("a^"),
+	},
+}
+
+/*proxyFront dials a front Arbiter to a client that answers the Dial pings, then issues a command with send
+and hands back the first reply it reads*/
+func proxyFront(t *testing.T, send func(conn net.Conn)) (Arbiter, <-chan string) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %v", err)
+	}
+	reply := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		for i := 0; i < 3; i++ {
+			n, _ := conn.Read(buf)
+			conn.Write(buf[:n])
+		}
+		time.Sleep(100 * time.Millisecond) //let Proxy start listening
+		send(conn)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(buf)
+		reply <- string(buf[:n])
+	}()
+	front := New("tcp")
+	if e := front.Dial(l.Addr().String(), 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Unable to dial front: %v", e)
+	}
+	return front, reply
+}
+
+func TestProxy(t *testing.T) {
+	defer func(d time.Duration) { ProxyListenTimeout = d }(ProxyListenTimeout)
+	ProxyListenTimeout = 50 * time.Millisecond
+
+	front, reply := proxyFront(t, func(conn net.Conn) { conn.Write([]byte("GET 42\r")) })
+	back := New("tcp")
+	if e := back.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Unable to dial back: %v", e)
+	}
+	defer back.Close()
+
+	done := make(chan error)
+	go func() { done <- Proxy(front, back, proxyCmds) }()
+
+	if r := <-reply; r != "GET 42\r" {
+		t.Fatalf("Client did not get the relayed reply: %q", r)
+	}
+	select { //client hung up, so Proxy should stop
+	case err := <-done:
+		if err == nil || err == ErrTimeout {
+			t.Fatalf("Proxy should return the closing error: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Proxy did not return after the front side closed")
+	}
+	front.Close()
+}
+
+func TestProxy_Split(t *testing.T) {
+	defer func(d time.Duration) { ProxyListenTimeout = d }(ProxyListenTimeout)
+	ProxyListenTimeout = 50 * time.Millisecond
+
+	front, reply := proxyFront(t, func(conn net.Conn) { //straddle a listen timeout
+		conn.Write([]byte("GET "))
+		time.Sleep(3 * ProxyListenTimeout)
+		conn.Write([]byte("42\r"))
+	})
+	defer front.Close()
+	back := New("tcp")
+	if e := back.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Unable to dial back: %v", e)
+	}
+	defer back.Close()
+	go Proxy(front, back, proxyCmds)
+
+	if r := <-reply; r != "GET 42\r" {
+		t.Fatalf("A command split across a listen timeout should still be relayed: %q", r)
+	}
+}
+
+func TestProxy_DeviceError(t *testing.T) {
+	defer func(d time.Duration) { ProxyListenTimeout = d }(ProxyListenTimeout)
+	ProxyListenTimeout = 50 * time.Millisecond
+
+	front, reply := proxyFront(t, func(conn net.Conn) { conn.Write([]byte("GET 42\r")) })
+	defer front.Close()
+	back := pipeTcp(t, func(conn net.Conn) { //refuses everything with a code
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte("ERR 42\r"))
+		}
+	})
+	defer back.Close()
+	get := proxyCmds["get"]
+	get.Response, get.Error, get.ErrorCodeGroup = regexp.MustCompile("OK\r"), regexp.MustCompile("ERR ([0-9]+)\r"), 1
+	done := make(chan error, 1)
+	go func() { done <- Proxy(front, back, Commands{"get": get}) }()
+
+	if r := <-reply; r != "ERR 42\r" {
+		t.Fatalf("A DeviceError reply should be relayed like any Error match: %q", r)
+	}
+	select {
+	case err := <-done:
+		var de DeviceError
+		if errors.As(err, &de) {
+			t.Fatalf("Proxy should not stop on a DeviceError: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Proxy did not return after the front side closed")
+	}
+}
+
+func TestProxy_Commands(t *testing.T) {
+	front, back := new(tcp), new(tcp)
+	for name, cmds := range map[string]Commands{
+		"none":   {},
+		"nil":    {"x": Command{Name: "x"}},
+		"greedy": {"x": Command{Name: "x", CommandRegexp: regexp.MustCompile(".*")}},
+	} {
+		if err := Proxy(front, back, cmds); !errors.Is(err, ErrProxyCommands) {
+			t.Errorf("Proxy should reject %s commands up front: %v", name, err)
+		}
+	}
+}
@@ -25,9 +25,17 @@ SOFTWARE.
 */
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 /*
@@ -37,9 +45,16 @@ when either the timeout occured, or the match was met. Error is any low-level er
 the actual stream transport, or one of this packages's named Err* errors.
 */
 type Response struct {
-	Bytes    []byte        //Raw bytes read or received.  In Control funcs, this is the raw value that matched the 'match' clause
-	Error    error         //any non-nil errors
-	Duration time.Duration //how long did the request take
+	Bytes            []byte        //Raw bytes read or received.  In Control funcs, this is the raw value that matched the 'match' clause
+	Error            error         //any non-nil errors
+	Duration         time.Duration //how long did the request take
+	FirstByteLatency time.Duration //how long after the request the first reply byte arrived, 0 if none did
+	ReadCount        int           //how many reads off the connection returned data for the reply
+	TotalRead        int           //how many bytes those reads returned, TotalRead/ReadCount being the average read size
+	ID               string        //correlation ID given to ControlID, empty otherwise
+	Slow             bool          //took longer than Command.SoftTimeout
+	Fallback         int           //how many Command.Fallbacks deep the form that answered was, 0 for the Command itself
+	Sent             []byte        //the request as formed by Command.Bytes, before any framing or wire codec
 }
 
 //String implements the Stringer interface
@@ -47,18 +62,252 @@ func (r Response) String() string {
 	return fmt.Sprintf("Response> Rx Bytes: %q\tErrors: %v\tDuration: %v", r.Bytes, r.Error, r.Duration)
 }
 
+/*Pretty is a human friendly alternative to String for text protocols.  Bytes are shown as text, with only
+control characters and invalid utf8 escaped*/
+func (r Response) Pretty() string {
+	return fmt.Sprintf("Response> Rx Bytes: %s\tErrors: %v\tDuration: %v", escape(string(r.Bytes)), r.Error, r.Duration)
+}
+
+/*MarshalJSON renders the Response for structured logs.  Bytes is a string, or base64 with "base64" set
+if it was not valid utf8, Error is the error message, ID and Slow are omitted if empty, and the durations
+are strings like "1.5s"*/
+func (r Response) MarshalJSON() ([]byte, error) {
+	j := struct {
+		ID               string `json:"id,omitempty"`
+		Bytes            string `json:"bytes"`
+		Base64           bool   `json:"base64,omitempty"`
+		Error            string `json:"error,omitempty"`
+		Duration         string `json:"duration"`
+		FirstByteLatency string `json:"first_byte_latency"`
+		Slow             bool   `json:"slow,omitempty"`
+		Fallback         int    `json:"fallback,omitempty"`
+		Sent             string `json:"sent,omitempty"`
+		SentBase64       bool   `json:"sent_base64,omitempty"`
+	}{
+		ID:               r.ID,
+		Bytes:            string(r.Bytes),
+		Duration:         r.Duration.String(),
+		FirstByteLatency: r.FirstByteLatency.String(),
+		Slow:             r.Slow,
+		Fallback:         r.Fallback,
+		Sent:             string(r.Sent),
+	}
+	if !utf8.Valid(r.Bytes) {
+		j.Bytes, j.Base64 = base64.StdEncoding.EncodeToString(r.Bytes), true
+	}
+	if !utf8.Valid(r.Sent) {
+		j.Sent, j.SentBase64 = base64.StdEncoding.EncodeToString(r.Sent), true
+	}
+	if r.Error != nil {
+		j.Error = r.Error.Error()
+	}
+	return json.Marshal(j)
+}
+
+/*Equal reports if r and other hold the same reply, for test assertions against scripted Responses.  Bytes
+are compared with bytes.Equal, and the Errors match if errors.Is holds in either direction, so a wrapped
+ErrTimeout equals a bare one.  Duration, FirstByteLatency, ReadCount and TotalRead vary run to run and are ignored*/
+func (r Response) Equal(other Response) bool {
+	return bytes.Equal(r.Bytes, other.Bytes) && (errors.Is(r.Error, other.Error) || errors.Is(other.Error, r.Error))
+}
+
 //ErrTimeout is the error returned when a command fails
 var ErrTimeout = errors.New("Didnt get the required response in the duration specified")
 
 //ErrBusy is returned if we are already busy with another command
 var ErrBusy = errors.New("Busy - Another operation in progress")
 
-//ErrNotConnected is returned if commands are sent on a closed connection
+//ErrQueueFull is returned if too many commands are already waiting their turn
+var ErrQueueFull = errors.New("Queue full - Too many commands waiting")
+
+//ErrNotConnected is returned if commands are sent on a closed connection, or in place of ErrTimeout if the
+//connection is found dead when the command times out
 var ErrNotConnected = errors.New("Not connected")
 
+//ErrCircuitOpen is returned while the circuit breaker is holding off commands to a failing device
+var ErrCircuitOpen = errors.New("Circuit open - Too many consecutive failures")
+
+//ErrPaused is returned if commands are sent while the Arbiter is paused
+var ErrPaused = errors.New("Paused - Not accepting commands")
+
+//ErrClosing is returned for new commands while CloseGraceful is waiting on those already queued
+var ErrClosing = errors.New("Closing - Not accepting commands")
+
+//ErrTransport matches any TransportError with errors.Is, ie any failure of the underlying connection
+var ErrTransport = errors.New("Transport error")
+
+//ErrConnClosed matches a TransportError with errors.Is if the peer closed the connection cleanly, with a FIN
+var ErrConnClosed = errors.New("Connection closed by peer")
+
+//ErrConnReset matches a TransportError with errors.Is if the peer reset the connection, such as on a crash
+var ErrConnReset = errors.New("Connection reset by peer")
+
+/*TransportError wraps errors coming from the underlying connection, rather than from this package, so
+errors.Is(err, ErrTransport) catches every connection level failure.  The original error is available
+via errors.Unwrap or errors.Is/As*/
+type TransportError struct {
+	Err error //error from the connection
+}
+
+//Error implements the error interface
+func (e *TransportError) Error() string {
+	return e.Err.Error()
+}
+
+//Unwrap returns the error from the connection
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+/*Is reports if target is ErrTransport, or tells how the peer closed the connection where the OS says so:
+ErrConnClosed for a clean close (EOF), and ErrConnReset for a reset (ECONNRESET)*/
+func (e *TransportError) Is(target error) bool {
+	switch target {
+	case ErrTransport:
+		return true
+	case ErrConnClosed:
+		return errors.Is(e.Err, io.EOF)
+	case ErrConnReset:
+		return errors.Is(e.Err, syscall.ECONNRESET)
+	}
+	return false
+}
+
+//ErrConnectFailed is the DialError.Kind when the connection could not be opened at all
+var ErrConnectFailed = errors.New("Unable to connect")
+
+//ErrPingFailed is the DialError.Kind when the connection opened, but the device did not answer the ping
+var ErrPingFailed = errors.New("Ping verification failed")
+
+//ErrSetupFailed is the DialError.Kind when the device answered the ping, but session setup then failed
+var ErrSetupFailed = errors.New("Connection setup failed")
+
+/*DialError is returned from Dial, and tells connection failures apart from devices that did not respond
+to the ping.  errors.Is(err, ErrConnectFailed) or errors.Is(err, ErrPingFailed) checks the Kind, and the
+underlying error is available via errors.Unwrap or errors.Is/As*/
+type DialError struct {
+	Kind error //ErrConnectFailed, ErrPingFailed, or ErrSetupFailed
+	Err  error //underlying error from the transport, the ping command, or session setup
+}
+
+//Error implements the error interface
+func (e *DialError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Kind, e.Err)
+}
+
+//Unwrap returns the underlying error
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+//Is reports if target is the Kind of the DialError
+func (e *DialError) Is(target error) bool {
+	return target == e.Kind
+}
+
+//DialResult describes how a connection came up, from Arbiter.DialWithResult
+type DialResult struct {
+	RemoteAddr net.Addr      //address of the peer, see Arbiter.RemoteAddr.  nil if it never connected
+	Pings      int           //ping commands issued to verify the connection
+	PingRTT    time.Duration //mean round trip time of the pings that succeeded
+}
+
+/*Snapshot is a point in time view of an Arbiter's health, from Arbiter.Snapshot, for admin and debug
+endpoints.  It marshals to JSON with the durations, state, and error as strings*/
+type Snapshot struct {
+	Connected    bool          //the connection is up
+	RemoteAddr   net.Addr      //see Arbiter.RemoteAddr
+	State        int           //StateIdle, StateWaitingOnReply or StateResponseFormed
+	LastError    error         //see Arbiter.LastError
+	Uptime       time.Duration //since the last successful Dial, 0 if not connected
+	StalledFor   time.Duration //see Arbiter.StalledFor
+	Queued       int           //see Arbiter.QueueLen
+	Failures     int           //consecutive failed commands, as counted for the circuit breaker
+	Paused       bool          //see Arbiter.Pause
+	BufferLen    int           //bytes received for the command in flight, or left over from the last
+	BytesRead    uint64        //see Arbiter.BytesRead
+	BytesWritten uint64        //see Arbiter.BytesWritten
+}
+
+//stateNames are the Snapshot.State values as marshalled to JSON
+var stateNames = map[int]string{
+	StateIdle:           "idle",
+	StateWaitingOnReply: "waiting on reply",
+	StateResponseFormed: "response formed",
+}
+
+//MarshalJSON makes the JSON version of a Snapshot
+func (s Snapshot) MarshalJSON() ([]byte, error) {
+	j := struct {
+		Connected    bool   `json:"connected"`
+		RemoteAddr   string `json:"remote_addr,omitempty"`
+		State        string `json:"state"`
+		LastError    string `json:"last_error,omitempty"`
+		Uptime       string `json:"uptime"`
+		StalledFor   string `json:"stalled_for"`
+		Queued       int    `json:"queued"`
+		Failures     int    `json:"failures"`
+		Paused       bool   `json:"paused"`
+		BufferLen    int    `json:"buffer_len"`
+		BytesRead    uint64 `json:"bytes_read"`
+		BytesWritten uint64 `json:"bytes_written"`
+	}{
+		Connected:    s.Connected,
+		State:        stateNames[s.State],
+		Uptime:       s.Uptime.String(),
+		StalledFor:   s.StalledFor.String(),
+		Queued:       s.Queued,
+		Failures:     s.Failures,
+		Paused:       s.Paused,
+		BufferLen:    s.BufferLen,
+		BytesRead:    s.BytesRead,
+		BytesWritten: s.BytesWritten,
+	}
+	if s.RemoteAddr != nil {
+		j.RemoteAddr = s.RemoteAddr.String()
+	}
+	if s.LastError != nil {
+		j.LastError = s.LastError.Error()
+	}
+	return json.Marshal(j)
+}
+
 //ErrMatch is returned if the provided error regex in command matches the bytes returned.
 var ErrMatch = errors.New("Card returned error response")
 
+/*DeviceError is returned in place of ErrMatch for commands with a Command.ErrorCodeGroup, carrying the
+error code the device reported.  errors.As(err, &DeviceError{}) gets at it, and errors.Is(err, ErrMatch)
+still holds*/
+type DeviceError struct {
+	Code int    //the error code from the ErrorCodeGroup submatch
+	Raw  []byte //the whole Error match
+}
+
+//Error implements the error interface
+func (e DeviceError) Error() string {
+	return fmt.Sprintf("%v: code %d (%q)", ErrMatch, e.Code, e.Raw)
+}
+
+//Is reports if target is ErrMatch
+func (e DeviceError) Is(target error) bool {
+	return target == ErrMatch
+}
+
+//ErrCooldown is returned if the device was still busy, matching Command.CooldownResponse, after all the retries
+var ErrCooldown = errors.New("Device busy - Still cooling down after retries")
+
+//ErrUnstable is returned by ControlStable if the responses never settled on one value
+var ErrUnstable = errors.New("Responses did not stabilize")
+
+//ErrResponseTooLarge is returned if more than Command.MaxResponseBytes arrived without a complete reply
+var ErrResponseTooLarge = errors.New("Response too large")
+
+//ErrUnexpected is returned, wrapped with what was received, by ControlExpect if the reply was not as expected
+var ErrUnexpected = errors.New("Unexpected response")
+
+//ErrValidate is returned if a reply matched Command.Response but was rejected by Command.Validate
+var ErrValidate = errors.New("Response failed validation")
+
 //errUnformedResponse is the internal error when the system is still waiting for a timeout, positive or negative reply.
 //this is not exported and only used internally
 var errUnformedResponse = errors.New("Unformed Response: still waiting for timeout, error match, or positive match to occur")
@@ -68,6 +317,10 @@ request is the corellary to Response.  This is passed to the go-routine for it t
 These are compiled by the function handlers and handeled by the go routine
 */
 type request struct {
-	Command Command //command to send in
-	bytes   []byte  //result of Command.Bytes() with passed args
+	Command  Command         //command to send in
+	bytes    []byte          //result of Command.Bytes() with passed args
+	ctx      context.Context //from ControlContext, nil otherwise
+	deadline time.Time       //from ControlDeadline, in place of Command.Timeout.  Zero otherwise
+	feed     *chunkFeed      //from ControlProgress, nil otherwise
+	queued   bool            //from ControlAsync, so it is still issued while CloseGraceful drains the queue
 }
@@ -26,11 +26,65 @@ SOFTWARE.
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+/*ChannelDepth is the capacity of the request and response channels between Control and the tcp runner.
+It is read when the first Dial makes them, as they then last for the life of the Arbiter.  With a depth
+of 0 the handoff is lock-step: a formed response can only be delivered at the instant the caller is
+waiting on it, and is otherwise retried on the next poll tick, adding latency jitter.  A depth of 1 lets
+the runner park a formed response and go idle immediately. Larger values buy nothing for a single caller
+and only let stale replies pile up, so the default of 1 should rarely need changing.*/
+var ChannelDepth = 1
+
+//dialSlots limits the Dials in progress at once across all Arbiters, nil if unlimited
+var dialSlots struct {
+	sync.Mutex
+	c chan struct{}
+}
+
+/*SetMaxConcurrentDials limits how many Dials, across every Arbiter in the process, may be in progress
+at once.  Further Dials block until a slot frees, and waiting for a slot counts against their timeout.
+A Dial that runs out of time while waiting fails with ErrConnectFailed wrapping ErrTimeout, having
+opened nothing.  n <= 0, the default, means no limit.  Dials already waiting keep the limit they
+started with*/
+func SetMaxConcurrentDials(n int) {
+	dialSlots.Lock()
+	defer dialSlots.Unlock()
+	dialSlots.c = nil
+	if n > 0 {
+		dialSlots.c = make(chan struct{}, n)
+	}
+}
+
+//acquireDial waits until deadline, by clk, for a dial slot.  The returned release must be called once
+//dialing is done
+func acquireDial(clk clock, deadline time.Time) (release func(), err error) {
+	dialSlots.Lock()
+	slots := dialSlots.c
+	dialSlots.Unlock()
+	if slots == nil {
+		return func() {}, nil
+	}
+	expired := make(chan bool)
+	defer clk.AfterFunc(deadline.Sub(clk.Now()), func() { close(expired) }).Stop()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
+	case <-expired:
+		return nil, ErrTimeout
+	}
+}
+
 //Internal Use only
 const (
 	idle           = iota //waitng for some incoming request
@@ -38,25 +92,102 @@ const (
 	responseFormed        //Response was formed
 )
 
+//The runner states handed to a SetStateObserver func
+const (
+	StateIdle           = idle           //waiting for a command
+	StateWaitingOnReply = waitingOnReply //command sent, waiting on the reply
+	StateResponseFormed = responseFormed //reply complete (or failed), waiting to be handed back
+)
+
+//runners counts the runner goroutines of every tcp, for Runners
+var runners atomic.Int64
+
+/*Runners returns how many Arbiters have a connection goroutine running, across the whole process.  Dial
+starts at most one per Arbiter, only leaving it running if Dial succeeds, and Close reaps it, so once every
+Arbiter is Closed this is 0.  It is meant for leak checks in tests and debugging*/
+func Runners() int {
+	return int(runners.Load())
+}
+
 /*tcp implements an Arbiter over a TCP socket.*/
 type tcp struct {
-	alive bool
-	addr  string //listen / address string, something like "some.hostname.tld:20321"
+	alive     atomic.Bool                                                //the runner is up
+	closeMu   sync.Mutex                                                 //serializes stopping the runner, so only one caller hands it stop
+	addr      string                                                     //listen / address string, something like "some.hostname.tld:20321"
+	network   string                                                     //network for net.Dialer, "tcp" if empty
+	dialer    func(addr string, timeout time.Duration) (net.Conn, error) //opens the connection; net.DialTimeout if nil
+	nagle     bool                                                       //leave Nagle's algorithm on, ie dont set TCP_NODELAY
+	fallback  time.Duration                                              //net.Dialer.FallbackDelay, from SetFallbackDelay
+	ping      Command                                                    //ping command given to Dial
+	onConnect func(a Arbiter) error                                      //session setup run by Dial after the pings
+	warmup    []Command                                                  //commands run by Dial after the pings, before onConnect
+	lifetime  time.Duration                                              //close this long after a successful Dial, 0 for never
+	expiry    timer                                                      //enforces lifetime for the current connection
+	clock     clock                                                      //times commands, realClock if nil
+	lastErr   atomic.Pointer[TransportError]                             //t.err, for LastError
+	observed  atomic.Pointer[runnerView]                                 //the runner as of the SetStateObserver call under way, nil if none
+	preamble  atomic.Value                                               //[]byte from SetPreamble, sent ahead of every command
+	wire      atomic.Value                                               //wireCodec from SetWireCodec
+	done      atomic.Value                                               //*connDone for the current connection, see Done
+	proxyHdr  bool                                                       //expect a PROXY protocol v1 header on connect
+	remote    atomic.Value                                               //net.Addr of the peer, see RemoteAddr
 
 	//The following are all used internally by the go-routine and should not be accessed outside of it
 	conn net.Conn     //network connection
 	ibuf bytes.Buffer //incomiong buffer from the network stack
-	tick *time.Ticker //poll ticker
+	tick ticker       //poll ticker
 	stop chan error   //set running to false and read from this to verify runner has stopped
 
 	//the following are used for communicating with the main routine
+	ctl      turn          //held by callers for the whole request/response exchange with the runner
+	paused   atomic.Bool   //reject new commands with ErrPaused
+	dryRun   atomic.Bool   //form commands without sending them, see SetDryRun
+	closing  atomic.Bool   //reject new commands with ErrClosing, see CloseGraceful
+	tapMu    sync.Mutex    //guards tapc, tapDone and tapLost
+	tapc     chan tapped   //wire traffic for the tap writer, nil if not tapped
+	tapDone  chan bool     //closed once the tap writer has drained tapc
+	tapLost  uint64        //chunks dropped since the tap writer last kept up
+	trMu     sync.Mutex    //guards the transcript, tr*
+	trMax    int           //most bytes of transcript kept, <= 0 for no transcript
+	trLog    [][]byte      //transcript records, oldest first
+	trSize   int           //total bytes in trLog
+	queued   atomic.Int64  //callers waiting on ctl
+	maxQueue atomic.Int64  //max callers allowed to wait on ctl, <= 0 for no limit
+	progress atomic.Int64  //UnixNano of the last byte sent or received for the command in flight, 0 if none
+	upAt     atomic.Int64  //UnixNano of the last successful Dial
+	gap      atomic.Int64  //time.Duration between bytes written, from SetInterByteDelay, 0 for none
+	rxTotal  atomic.Uint64 //bytes read off every connection since the tcp was made
+	txTotal  atomic.Uint64 //bytes written to every connection since the tcp was made
+	observer atomic.Value  //func(from, to int) from SetStateObserver, nil if none
+	cbMu     sync.Mutex    //guards the circuit breaker, cb*
+	cbLimit  int           //consecutive failures that open the circuit, <= 0 for no circuit breaker
+	cbWait   time.Duration //how long the circuit stays open before a trial command
+	cbFails  int           //consecutive failed commands
+	cbOpen   time.Time     //when the circuit last opened
+	cache    sync.Map      //cached Responses of commands with a CacheTTL, by cacheKey
+	asyncMu  sync.Mutex    //guards async, asyncN and asyncOn
+	async    []asyncCmd    //ControlAsync commands waiting to be issued, in order
+	asyncN   int64         //entries of async still to be issued, rather than failed
+	asyncOn  bool          //an async worker is draining async
 	request  request       //the request we are working from
 	response Response      //the reponse
 	reqTime  time.Time     //time request came in
+	rxTime   time.Time     //time the first byte of the reply arrived, zero until then
+	reads    int           //reads that returned data since the request went out
+	rxBytes  int           //bytes read since the request went out
+	contAt   int           //how far into ibuf continuation prompts have been answered
+	scanAt   int           //how far into ibuf Streaming has searched without finding a reply
+	paced    []byte        //request bytes still to be written a byte at a time, see SetInterByteDelay
+	paceAt   time.Time     //when the next paced byte is due
+	chans    sync.Once     //makes sreq, sresp and stop, once
+	peek     chan func()   //funcs run by the runner between polls, for Snapshot
 	sreq     chan request  //incoming requests
 	sresp    chan Response //outgoing responses
+	settleMu sync.Mutex    //guards settled
+	settled  chan bool     //closed as commands finish or leave the queue, for CloseGraceful and WaitIdle
 	state    int           // state machine for
 	err      error         //error vars
+	errs     []error       //every distinct transport error since Dial, for Close
 }
 
 /*
@@ -64,93 +195,1188 @@ Close attempts to close down the tcp connections.  After Close is called,
 tcp will no longer be functional, and any data in route will be dropped.
 This does nothing if the underlying goroutine is not functional, and will block
 until everything is closed.  If any errors are encountered, this will return a
-non-nil error.
+non-nil error.  That error joins (see errors.Join) every distinct transport error the connection
+suffered since Dial with any error closing it, so the root cause of a disconnect is not lost.
 */
 func (t *tcp) Close() error {
-	if t.alive {
-		to := time.NewTicker(time.Duration(40) * time.Millisecond)
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	t.dropAsync(ErrNotConnected)
+	return t.shut()
+}
+
+//shut stops the runner, if there is one.  closeMu must be held
+func (t *tcp) shut() error {
+	if t.alive.Load() {
+		to := t.clk().NewTicker(time.Duration(40) * time.Millisecond)
 		defer func() { to.Stop() }()
 		t.stop <- nil //lock step with goroutine
 		select {      //block waiting for
-		case <-to.C: //timeout.  Error out
+		case <-to.C(): //timeout.  Error out
 			return ErrTimeout
 		case err := <-t.stop:
-			close(t.stop)
 			return err //return any errors
 		}
 	}
 	return nil
 }
 
+/*CloseGraceful is Close for a clean shutdown.  New commands are rejected with ErrClosing straight away,
+but those already queued, whether Control calls waiting their turn or ControlAsync commands, are still
+issued.  Once they are done, or timeout passes, the connection is closed as with Close.  If the queue did
+not drain in time it is closed anyway, with whatever is left abandoned, and the error carries ErrTimeout*/
+func (t *tcp) CloseGraceful(timeout time.Duration) error {
+	t.closing.Store(true)
+	defer t.closing.Store(false) //a later Dial takes commands again
+	expired := make(chan bool)
+	defer t.clk().AfterFunc(timeout, func() { close(expired) }).Stop()
+	for {
+		settled := t.settling() //before checking, so a command finishing in between still wakes us
+		if t.drained() {
+			return t.Close()
+		}
+		select {
+		case <-settled: //something finished, check again
+		case <-expired:
+			return errors.Join(ErrTimeout, t.Close())
+		}
+	}
+}
+
+//settling returns a channel closed by the next settle
+func (t *tcp) settling() <-chan bool {
+	t.settleMu.Lock()
+	defer t.settleMu.Unlock()
+	if t.settled == nil {
+		t.settled = make(chan bool)
+	}
+	return t.settled
+}
+
+//settle wakes anyone waiting on the queue, after a command finishes or leaves the queue
+func (t *tcp) settle() {
+	t.settleMu.Lock()
+	defer t.settleMu.Unlock()
+	if t.settled != nil { //otherwise nobody is waiting
+		close(t.settled)
+		t.settled = nil
+	}
+}
+
+//turn is a mutex whose waiters can give up, see lock.  Its zero value is free
+type turn struct {
+	once sync.Once
+	c    chan struct{} //holds a token while taken
+}
+
+//ch returns the token channel, made on first use
+func (l *turn) ch() chan struct{} {
+	l.once.Do(func() { l.c = make(chan struct{}, 1) })
+	return l.c
+}
+
+//Lock waits for the turn
+func (l *turn) Lock() {
+	l.ch() <- struct{}{}
+}
+
+//lock waits for the turn, or until done is closed, and reports if it got it
+func (l *turn) lock(done <-chan struct{}) bool {
+	select {
+	case l.ch() <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+//TryLock takes the turn if it is free, and reports if it did
+func (l *turn) TryLock() bool {
+	select {
+	case l.ch() <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+//Unlock hands the turn on
+func (l *turn) Unlock() {
+	<-l.ch()
+}
+
+//unlock releases ctl once a command is done with it
+func (t *tcp) unlock() {
+	t.ctl.Unlock()
+	t.settle()
+}
+
+//drained reports if no command is in flight or waiting to be issued
+func (t *tcp) drained() bool {
+	t.asyncMu.Lock()
+	async := t.asyncOn
+	t.asyncMu.Unlock()
+	if async || t.queued.Load() > 0 || !t.ctl.TryLock() {
+		return false
+	}
+	t.ctl.Unlock()
+	return true
+}
+
 /*Dial opens the TCP socket and starts the internal structures buffering data comming off the
 socket.  This does maintain a goroutine in the background.  Use Close to stop everthing and kill
-off the goroutine*/
+off the goroutine.  timeout bounds the whole Dial, from connecting through all of the ping
+verification, and pings are cut short with ErrTimeout as needed.  Dialing an Arbiter that is already
+connected Closes the existing connection first.  Any error returned is a *DialError, telling a
+failure to connect (ErrConnectFailed) apart from a device that did not answer the ping
+(ErrPingFailed).  A ping answered with an Error match fails Dial straight away with ErrPingFailed
+wrapping ErrMatch, so "device says no" is not retried like a silent device*/
 func (t *tcp) Dial(addr string, timeout time.Duration, pingCmd Command) error {
+	_, err := t.DialWithResult(addr, timeout, pingCmd)
+	return err
+}
+
+/*DialWithResult is Dial, also describing how the connection came up in the DialResult.  It is filled in as
+far as Dial got, even on error*/
+func (t *tcp) DialWithResult(addr string, timeout time.Duration, pingCmd Command) (res DialResult, err error) {
+	err = t.dial(addr, timeout, pingCmd, &res)
+	return res, err
+}
+
+//dial implements Dial, filling in res as it goes
+func (t *tcp) dial(addr string, timeout time.Duration, pingCmd Command, res *DialResult) error {
+	clk := t.clk()
+	deadline := clk.Now().Add(timeout)
+	t.Close()            //redialing, dont orphan the current runner, nor race one being stopped
+	if t.expiry != nil { //a previous connection's lifetime does not carry over
+		t.expiry.Stop()
+	}
+	release, err := acquireDial(clk, deadline)
+	if err != nil {
+		return &DialError{Kind: ErrConnectFailed, Err: err}
+	}
+	defer release()
 	t.addr = addr
-	t.conn, t.err = net.DialTimeout("tcp", t.addr, timeout)
+	t.ping = pingCmd
+	t.CacheClear()
+	t.trMu.Lock()
+	t.trLog, t.trSize = nil, 0
+	t.trMu.Unlock()
+	timeout = deadline.Sub(clk.Now()) //less any wait for a dial slot
+	if t.dialer != nil {
+		t.conn, t.err = t.dialer(t.addr, timeout)
+	} else {
+		network := t.network
+		if network == "" {
+			network = "tcp"
+		}
+		d := net.Dialer{Timeout: timeout, FallbackDelay: t.fallback}
+		t.conn, t.err = d.Dial(network, t.addr)
+	}
 	if t.err != nil {
-		return t.err
+		t.fail(t.err)
+		return &DialError{Kind: ErrConnectFailed, Err: t.err}
+	}
+	t.lastErr.Store(nil)
+	remote := t.conn.RemoteAddr()
+	if t.proxyHdr {
+		if remote, err = readProxyHeader(t.conn, time.Now().Add(deadline.Sub(clk.Now()))); err != nil { //sockets go by the wall clock
+			t.conn.Close()
+			return &DialError{Kind: ErrConnectFailed, Err: err}
+		}
+		if remote == nil { //PROXY UNKNOWN
+			remote = t.conn.RemoteAddr()
+		}
+	}
+	t.remote.Store(&remote)
+	res.RemoteAddr = remote
+	if tc, ok := t.conn.(*net.TCPConn); ok { //small latency sensitive exchanges dont want to wait on Nagle
+		tc.SetNoDelay(!t.nagle)
 	}
 
+	t.channels()
+	t.done.Store(&connDone{ch: make(chan struct{}), exited: make(chan struct{})})
 	setup := make(chan bool)
 	go t.runner(setup)
 	<-setup //wait for go-routine to signal it started
 	close(setup)
 
-	_, err := pingCmd.Bytes()
-	if err != nil {
+	if _, err := pingCmd.Bytes(); err != nil {
 		panic("tcp Ping command cannot require args")
 	}
 
-	//Make sure sock is alive by sending ping command a couple times
+	//Make sure sock is alive by sending ping command a couple times, all within timeout
 	for i := 0; i < 3; i++ {
-		if resp := t.Control(pingCmd); resp.Error != nil {
-			t.stop <- nil //lock step with goroutine
-			<-t.stop
-			return resp.Error
+		ping := pingCmd
+		if left := deadline.Sub(clk.Now()); left < ping.Timeout {
+			ping.Timeout = left
+		}
+		resp := Response{Error: ErrTimeout}
+		if ping.Timeout > 0 {
+			resp = t.Control(ping)
+			res.Pings++
+		}
+		if resp.Error != nil { //any failure, ErrMatch included, ends verification on the spot
+			t.halt()
+			return &DialError{Kind: ErrPingFailed, Err: resp.Error}
+		}
+		res.PingRTT += (resp.Duration - res.PingRTT) / time.Duration(i+1) //running mean
+	}
+
+	for _, cmd := range t.warmup {
+		if resp := t.Control(cmd); resp.Error != nil {
+			t.halt()
+			return &DialError{Kind: ErrSetupFailed, Err: fmt.Errorf("Warmup command %q failed: %w", cmd.Name, resp.Error)}
+		}
+	}
+
+	if t.onConnect != nil {
+		if err := t.onConnect(t); err != nil {
+			t.halt()
+			return &DialError{Kind: ErrSetupFailed, Err: err}
 		}
 	}
+	if t.lifetime > 0 {
+		d, _ := t.done.Load().(*connDone)
+		t.expiry = clk.AfterFunc(t.lifetime, func() { t.expire(d) })
+	}
+	t.upAt.Store(clk.Now().UnixNano())
+	return nil
+}
+
+//connDone is closed once a connection is finished with, see Done
+type connDone struct {
+	ch     chan struct{}
+	once   sync.Once
+	exited chan struct{} //closed once the connection's runner has returned
+}
+
+//closedDone is what Done returns before the first Dial
+var closedDone = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+/*Done returns a channel that is closed once the current connection is finished with, for any reason:
+Close, a transport error, a failed Dial, or SetMaxLifetime running out.  Goroutines that depend on the
+connection can select on it to shut down with it.  Each successful Dial starts a new connection with a
+new channel, and before the first Dial it is already closed*/
+func (t *tcp) Done() <-chan struct{} {
+	if d, _ := t.done.Load().(*connDone); d != nil {
+		return d.ch
+	}
+	return closedDone
+}
+
+//exited returns a channel closed once the current connection's runner has returned
+func (t *tcp) exited() <-chan struct{} {
+	if d, _ := t.done.Load().(*connDone); d != nil {
+		return d.exited
+	}
+	return closedDone
+}
+
+//finish closes the current connection's Done channel
+func (t *tcp) finish() {
+	if d, _ := t.done.Load().(*connDone); d != nil {
+		d.once.Do(func() { close(d.ch) })
+	}
+}
+
+/*SetExpectProxyHeader has subsequent Dials read a PROXY protocol v1 header, as prepended by HAProxy style
+front ends, off the connection before anything else, so it does not land in front of the first ping.  The
+address it gives is then what RemoteAddr returns.  A missing or malformed header fails Dial with
+ErrConnectFailed wrapping ErrProxyHeader*/
+func (t *tcp) SetExpectProxyHeader(expect bool) {
+	t.proxyHdr = expect
+}
+
+/*RemoteAddr returns the address of the peer of the current connection, or the last one if closed.  With
+SetExpectProxyHeader, it is the source address from the PROXY header.  It is nil before the first Dial*/
+func (t *tcp) RemoteAddr() net.Addr {
+	if a, _ := t.remote.Load().(*net.Addr); a != nil {
+		return *a
+	}
 	return nil
 }
 
+//ErrProxyHeader is wrapped in the DialError when SetExpectProxyHeader is set and the header is missing or bad
+var ErrProxyHeader = errors.New("Bad PROXY protocol header")
+
+/*readProxyHeader reads a PROXY protocol v1 header off conn, byte by byte so nothing after it is consumed,
+and returns the source address it gives.  That is nil for "PROXY UNKNOWN"*/
+func readProxyHeader(conn net.Conn, deadline time.Time) (net.Addr, error) {
+	conn.SetReadDeadline(deadline)
+	defer conn.SetReadDeadline(time.Time{})
+	line := make([]byte, 0, 107) //longest a v1 header can be
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("%w: no CRLF in %q", ErrProxyHeader, line)
+		}
+		var b [1]byte
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrProxyHeader, err)
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Fields(string(line))
+	switch {
+	case len(f) >= 2 && f[0] == "PROXY" && f[1] == "UNKNOWN":
+		return nil, nil
+	case len(f) != 6 || f[0] != "PROXY" || f[1] != "TCP4" && f[1] != "TCP6":
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (f[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: %q", ErrProxyHeader, line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+//clk returns the clock used to time commands
+func (t *tcp) clk() clock {
+	if t.clock == nil {
+		return realClock{}
+	}
+	return t.clock
+}
+
+/*expire closes the connection d once its lifetime is up, after letting any command in flight finish.  By
+then a later Dial may have replaced it, in which case the new connection is left be*/
+func (t *tcp) expire(d *connDone) {
+	t.ctl.Lock()
+	defer t.unlock()
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	if cur, _ := t.done.Load().(*connDone); cur == d {
+		t.shut()
+	}
+}
+
+/*channels makes the channels between callers and the runner, sreq, sresp, stop and peek.  They
+are made once, by the constructors or else the first Dial, and outlive each connection, so that
+reconnecting swaps only the net.Conn and never a channel a caller may be using*/
+func (t *tcp) channels() {
+	t.chans.Do(func() {
+		t.stop = make(chan error)
+		t.peek = make(chan func())
+		t.sreq = make(chan request, ChannelDepth)
+		t.sresp = make(chan Response, ChannelDepth)
+	})
+}
+
+//halt stops the runner from within Dial, when the connection turned out to be unusable
+func (t *tcp) halt() {
+	t.closeMu.Lock()
+	defer t.closeMu.Unlock()
+	t.stop <- nil //lock step with goroutine
+	<-t.stop
+}
+
+/*SetWarmup sets commands that Dial issues, in order, once the connection has answered its pings and
+before any SetOnConnect func, such as disabling paging.  They take no args.  If any fails, the connection
+is torn down and Dial fails with ErrSetupFailed, naming the command.  nil removes them*/
+func (t *tcp) SetWarmup(cmds []Command) {
+	t.warmup = append([]Command(nil), cmds...)
+}
+
+/*SetOnConnect sets a function that Dial calls once the connection is up and has answered its pings, to
+do any session setup such as logging in.  If it returns an error, the connection is torn down and Dial
+fails with ErrSetupFailed.  nil removes it*/
+func (t *tcp) SetOnConnect(fn func(a Arbiter) error) {
+	t.onConnect = fn
+}
+
+/*SetPreamble has b sent immediately before the bytes of every command, in the same write, such as an
+attention sequence to wake a sleeping device.  The preamble is not part of what CommandRegexp checks, nor
+of what EchoConfirm expects back.  An empty b, the default, sends nothing extra*/
+func (t *tcp) SetPreamble(b []byte) {
+	t.preamble.Store(append([]byte(nil), b...))
+}
+
+//wireCodec is the pair of transforms given to SetWireCodec
+type wireCodec struct {
+	enc, dec func([]byte) []byte
+}
+
+/*SetWireCodec has every outgoing request passed through enc just before it is written, and every chunk
+read off the connection passed through dec before it is buffered, such as to tunnel binary traffic over a
+text only channel with base64.  Commands, their matching, and the Responses all deal in decoded bytes,
+while Tap shows what is actually on the wire.  dec is handed chunks as they are read, so it must hold on to
+any partial input itself, returning only what it can decode so far.  nil for either means no transform,
+the default*/
+func (t *tcp) SetWireCodec(enc, dec func([]byte) []byte) {
+	t.wire.Store(wireCodec{enc: enc, dec: dec})
+}
+
+//encode passes b through any SetWireCodec enc
+func (t *tcp) encode(b []byte) []byte {
+	if w, _ := t.wire.Load().(wireCodec); w.enc != nil {
+		return w.enc(b)
+	}
+	return b
+}
+
+/*SetMaxLifetime closes the connection d after each subsequent successful Dial, regardless of activity,
+after which Control returns ErrNotConnected until the next Dial.  A command in flight when d elapses
+is allowed to finish first.  d <= 0, the default, means connections live until Closed*/
+func (t *tcp) SetMaxLifetime(d time.Duration) {
+	t.lifetime = d
+}
+
 /*Control is a Request-Reply patern. It sends out the request, and wait up to timeout for
 a reply that matched the passed regexp.  The returned Response structure holds the bytes read, as
 well as easy way to get to the reply data.  The command is considered "successful" if the reply
 matches anywhere in the incoming byte stream from the remote host.  Any internal buffers are
 flushed before the request is issued.  If an error is returned, Response.Bytes will be the contents
 of whatever was on the incoming buffer.  If error is nil, Response.Bytes will be whatever byte slice
-matched cmd.Response, with extra bytes removed.
+matched cmd.Response, with extra bytes removed.  A reply matching cmd.CooldownResponse is not returned,
+rather the command is re-issued after cmd.Cooldown, holding off any other commands meanwhile.  If the
+reply times out or matches cmd.Error, cmd.Fallback is issued in its place, if there is one, and so on
+down its chain.  The other Control funcs, TryControl included, do the same.
 */
 func (t *tcp) Control(cmd Command, args ...interface{}) Response {
-	if !t.alive {
+	return t.control(request{Command: cmd}, args...)
+}
+
+/*ControlDeadline is Control with the absolute deadline for the reply in place of cmd.Timeout.  If the
+deadline passes before the reply is complete the Response carries ErrTimeout, as with Control*/
+func (t *tcp) ControlDeadline(cmd Command, deadline time.Time, args ...interface{}) Response {
+	return t.control(request{Command: cmd, deadline: deadline}, args...)
+}
+
+/*ControlContext is Control bounded by ctx as well as cmd.Timeout, whichever deadline comes first.  If
+cmd.Timeout runs out first the Response carries ErrTimeout, and if ctx is cancelled or its deadline
+passes first it carries ctx.Err(), so callers can tell the two apart.  The Timeout is counted from
+when the command goes on the wire, but ctx also covers any wait for the command in flight, with the
+call giving up its place in the queue once ctx is done*/
+func (t *tcp) ControlContext(ctx context.Context, cmd Command, args ...interface{}) Response {
+	if err := ctx.Err(); err != nil {
+		return Response{Error: err}
+	}
+	return t.control(request{Command: cmd, ctx: ctx}, args...)
+}
+
+/*ControlID is Control with a correlation ID, such as a request ID from the caller's own logs, that is
+handed back in Response.ID so each Response can be traced back to the call that issued it*/
+func (t *tcp) ControlID(id string, cmd Command, args ...interface{}) Response {
+	r := t.control(request{Command: cmd}, args...)
+	r.ID = id
+	return r
+}
+
+/*ControlAsync queues cmd with args and returns straight away, with cb called with the Response once the
+command completes, for event driven code that cannot block on Control.  Async commands are issued one at a
+time in the order queued, taking their turn with synchronous Control calls, and count towards SetMaxQueue
+while they wait.  One queued past that limit fails with ErrQueueFull, and Close fails any not yet issued
+with ErrNotConnected.  cb is always called, in order, from a goroutine of the Arbiter's that issues the next
+async command once cb returns, never from ControlAsync itself, so it should not block for long*/
+func (t *tcp) ControlAsync(cmd Command, cb func(Response), args ...interface{}) {
+	t.asyncMu.Lock()
+	defer t.asyncMu.Unlock()
+	a := asyncCmd{cmd: cmd, cb: cb, args: args}
+	if max := t.maxQueue.Load(); max > 0 && t.queued.Load()+t.asyncN >= max {
+		a.err = ErrQueueFull
+	} else {
+		t.asyncN++
+	}
+	t.async = append(t.async, a)
+	if !t.asyncOn {
+		t.asyncOn = true
+		go t.drainAsync()
+	}
+}
+
+//asyncCmd is a ControlAsync command waiting its turn
+type asyncCmd struct {
+	cmd  Command
+	cb   func(Response)
+	args []interface{}
+	err  error //fails the command without issuing it, if not nil
+}
+
+//drainAsync issues queued async commands until there are none left
+func (t *tcp) drainAsync() {
+	for {
+		t.asyncMu.Lock()
+		if len(t.async) == 0 {
+			t.asyncOn = false
+			t.asyncMu.Unlock()
+			t.settle()
+			return
+		}
+		next := t.async[0]
+		t.async = t.async[1:]
+		if next.err == nil {
+			t.asyncN--
+		}
+		t.asyncMu.Unlock()
+		r := Response{Error: next.err}
+		if next.err == nil {
+			r = t.control(request{Command: next.cmd, queued: true}, next.args...)
+		}
+		if next.cb != nil {
+			next.cb(r)
+		}
+	}
+}
+
+//dropAsync fails every async command not yet issued with err, leaving drainAsync to tell their callbacks
+func (t *tcp) dropAsync(err error) {
+	t.asyncMu.Lock()
+	defer t.asyncMu.Unlock()
+	for i := range t.async {
+		if t.async[i].err == nil {
+			t.async[i].err = err
+			t.asyncN--
+		}
+	}
+}
+
+//waiting returns how many commands are waiting their turn, both Control calls and ControlAsync commands
+func (t *tcp) waiting() int64 {
+	t.asyncMu.Lock()
+	defer t.asyncMu.Unlock()
+	return t.queued.Load() + t.asyncN
+}
+
+/*ControlProgress is Control that also hands onChunk each piece of the reply as it arrives, such as the
+progress lines of a firmware flash ahead of its final "DONE", so progress can be shown before the command
+completes.  onChunk is called from the calling goroutine, never the runner, and has had every piece by the
+time ControlProgress returns.  The Response is the same as from Control*/
+func (t *tcp) ControlProgress(cmd Command, onChunk func([]byte), args ...interface{}) Response {
+	return t.control(request{Command: cmd, feed: &chunkFeed{fn: onChunk, ready: make(chan bool, 1)}}, args...)
+}
+
+//chunkFeed carries reply bytes from the runner to a ControlProgress caller, without the runner blocking
+type chunkFeed struct {
+	fn      func([]byte) //the caller's onChunk
+	mu      sync.Mutex   //guards pending
+	pending []byte       //received but not yet handed to fn
+	ready   chan bool    //signalled when pending grows
+}
+
+//put queues a copy of b for the caller
+func (f *chunkFeed) put(b []byte) {
+	f.mu.Lock()
+	f.pending = append(f.pending, b...)
+	f.mu.Unlock()
+	select {
+	case f.ready <- true:
+	default: //already signalled
+	}
+}
+
+//flush hands everything pending to fn
+func (f *chunkFeed) flush() {
+	f.mu.Lock()
+	b := f.pending
+	f.pending = nil
+	f.mu.Unlock()
+	if len(b) > 0 {
+		f.fn(b)
+	}
+}
+
+//exchange hands ireq to the runner and returns its Response.  gone is the runner's exited channel: as
+//the channels outlive the runner, a caller would otherwise wait forever on one that has stopped
+func (t *tcp) exchange(gone <-chan struct{}, ireq request) Response {
+	select {
+	case t.sreq <- ireq: //lock step, waiting for goroutine to respond
+	case <-gone:
 		return Response{Error: ErrNotConnected}
 	}
-	ireq := request{Command: cmd}
+	return t.await(gone, ireq.feed)
+}
+
+//await returns the runner's Response to the request in flight, feeding feed meanwhile if it is not nil
+func (t *tcp) await(gone <-chan struct{}, feed *chunkFeed) Response {
+	var ready chan bool
+	if feed != nil {
+		ready = feed.ready
+	}
+	for {
+		var r Response
+		select {
+		case <-ready:
+			feed.flush()
+			continue
+		case r = <-t.sresp:
+		case <-gone:
+			r = Response{Error: ErrNotConnected}
+			select {
+			case r = <-t.sresp: //sent just before the runner returned
+			default:
+			}
+		}
+		if feed != nil {
+			feed.flush() //whatever came in with the end of the reply
+		}
+		return r
+	}
+}
+
+//control implements the Control funcs, issuing ireq.Command with args.  ireq may also carry a ctx,
+//deadline, or progress feed
+func (t *tcp) control(ireq request, args ...interface{}) Response {
+	cmd, ctx := ireq.Command, ireq.ctx
+	if t.dryRun.Load() {
+		b, err := cmd.Bytes(args...)
+		return Response{Sent: b, Error: err}
+	}
+	if !t.alive.Load() {
+		return Response{Error: ErrNotConnected}
+	}
+	if t.paused.Load() {
+		return Response{Error: ErrPaused}
+	}
 	//Check if the command can even be properly expanded with the args provided
 	var err error
 	ireq.bytes, err = cmd.Bytes(args...)
 	if err != nil {
 		return Response{Error: err}
 	}
-	t.sreq <- ireq //lock step, waiting for goroutine to respond
-	r := <-t.sresp
+	ireq.Command = cmd.bind(args)
+	if r, ok := t.cached(cmd, ireq.bytes); ok {
+		return r
+	}
+	if t.circuitOpen() {
+		return Response{Error: ErrCircuitOpen}
+	}
+	t.queued.Add(1) //before checking closing, so CloseGraceful either sees us queued or we see it closing
+	if t.closing.Load() && !ireq.queued {
+		t.queued.Add(-1)
+		t.settle()
+		return Response{Error: ErrClosing}
+	}
+	if max := t.maxQueue.Load(); max > 0 && !ireq.queued && t.waiting() > max { //async commands got their place when queued
+		t.queued.Add(-1)
+		t.settle()
+		return Response{Error: ErrQueueFull}
+	}
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	if !t.ctl.lock(done) { //gave up while waiting our turn
+		t.queued.Add(-1)
+		t.settle()
+		return Response{Error: ctx.Err()}
+	}
+	t.queued.Add(-1)
+	defer t.unlock()
+	gone := t.exited()
+	if !t.alive.Load() { //closed while waiting our turn
+		return Response{Error: ErrNotConnected}
+	}
+	if ctx != nil && ctx.Err() != nil { //done just as our turn came
+		return Response{Error: ctx.Err()}
+	}
+	if t.circuitOpen() { //opened by the command we waited on
+		return Response{Error: ErrCircuitOpen}
+	}
+	r := t.exchange(gone, ireq)
+	r.Sent = ireq.bytes
+	return t.followUp(gone, ireq, r, args...)
+}
+
+//followUp takes r, the runner's Response to ireq, through cooldown retries and cmd.Fallback, then tallies it
+//for the circuit breaker and caches it.  It is called with ctl held
+func (t *tcp) followUp(gone <-chan struct{}, ireq request, r Response, args ...interface{}) Response {
+	cmd, ctx := ireq.Command, ireq.ctx
+	for n := 0; r.Error == ErrCooldown && n < cmd.CooldownRetries; n++ { //device asked us to back off
+		var done <-chan struct{}
+		if ctx != nil {
+			done = ctx.Done()
+		}
+		cooled := make(chan bool)
+		tm := t.clk().AfterFunc(cmd.Cooldown, func() { close(cooled) })
+		select {
+		case <-cooled:
+		case <-done:
+			tm.Stop()
+			return Response{Error: ctx.Err()}
+		}
+		if !t.alive.Load() {
+			return Response{Error: ErrNotConnected}
+		}
+		r = t.exchange(gone, ireq)
+		r.Sent = ireq.bytes
+	}
+	freq := ireq
+	for fb, depth := cmd.Fallback, 1; fb != nil && depth <= MaxFallbackDepth; fb, depth = fb.Fallback, depth+1 {
+		if !errors.Is(r.Error, ErrTimeout) && !errors.Is(r.Error, ErrMatch) {
+			break
+		}
+		var err error
+		if freq.bytes, err = fb.Bytes(args...); err != nil {
+			r = Response{Error: err}
+			break
+		}
+		freq.Command = fb.bind(args)
+		r = t.exchange(gone, freq)
+		r.Fallback, r.Sent = depth, freq.bytes
+	}
+	t.tally(r.Error)
+	if cmd.CacheTTL > 0 && r.Error == nil {
+		c := cached{resp: r, at: t.clk().Now()}
+		c.resp.Bytes = append([]byte(nil), r.Bytes...) //dont alias the runner's buffer, or the caller's copy
+		t.cache.Store(cacheKey(cmd, ireq.bytes), c)
+	}
 	return r
 }
 
+/*WaitIdle blocks until no command is in flight, or returns ErrTimeout if that takes longer than
+timeout.  Commands queued behind the one in flight may start as soon as this returns*/
+func (t *tcp) WaitIdle(timeout time.Duration) error {
+	expired := make(chan bool)
+	defer t.clk().AfterFunc(timeout, func() { close(expired) }).Stop()
+	for {
+		settled := t.settling() //before checking, so a command finishing in between still wakes us
+		if t.ctl.TryLock() { //only free between commands
+			t.ctl.Unlock()
+			return nil
+		}
+		select {
+		case <-settled:
+		case <-expired:
+			return ErrTimeout
+		}
+	}
+}
+
+/*SetMaxQueue limits how many Control calls and ControlAsync commands may wait for their turn behind the
+command in flight.  Once n are waiting, Control returns ErrQueueFull right away, as does ControlAsync through
+its callback.  n <= 0, the default, means no limit*/
+func (t *tcp) SetMaxQueue(n int) {
+	t.maxQueue.Store(int64(n))
+}
+
+//QueueLen returns how many Control calls and ControlAsync commands are waiting for their turn behind the
+//command in flight
+func (t *tcp) QueueLen() int {
+	return int(t.waiting())
+}
+
+/*TryControl is the non-blocking form of Control.  If another command is in flight, or the runner
+cannot take the request right now, it returns a zero Response and false without queuing anything.
+Otherwise it behaves exactly like Control, cooldown retries, cmd.Fallback and cmd.CacheTTL included, and
+returns its Response and true.  A fresh cached Response is returned straight away, even with another
+command in flight.  Only taking the turn is non-blocking: once sent, it waits out the reply and any
+retries or Fallbacks like Control does*/
+func (t *tcp) TryControl(cmd Command, args ...interface{}) (Response, bool) {
+	if t.dryRun.Load() {
+		b, err := cmd.Bytes(args...)
+		return Response{Sent: b, Error: err}, true
+	}
+	if !t.alive.Load() {
+		return Response{}, false
+	}
+	if t.paused.Load() {
+		return Response{Error: ErrPaused}, true
+	}
+	if t.closing.Load() {
+		return Response{Error: ErrClosing}, true
+	}
+	ireq := request{Command: cmd}
+	var err error
+	if ireq.bytes, err = cmd.Bytes(args...); err != nil {
+		return Response{Error: err}, true
+	}
+	ireq.Command = cmd.bind(args)
+	if r, ok := t.cached(cmd, ireq.bytes); ok {
+		return r, true
+	}
+	if t.circuitOpen() {
+		return Response{Error: ErrCircuitOpen}, true
+	}
+	if !t.ctl.TryLock() { //another caller is mid-exchange
+		return Response{}, false
+	}
+	defer t.unlock()
+	if t.closing.Load() { //CloseGraceful began while we took ctl
+		return Response{Error: ErrClosing}, true
+	}
+	gone := t.exited()
+	select {
+	case t.sreq <- ireq:
+	default: //runner is not sitting idle on sreq
+		return Response{}, false
+	}
+	r := t.await(gone, nil)
+	r.Sent = ireq.bytes
+	return t.followUp(gone, ireq, r, args...), true
+}
+
+/*StalledFor returns how long the command in flight has gone without receiving a byte, or since it was
+sent if nothing has arrived yet.  A watchdog can use it to tell a slow but progressing reply from a hung
+one well before the Timeout.  It is 0 if no command is in flight*/
+func (t *tcp) StalledFor() time.Duration {
+	last := t.progress.Load()
+	if last == 0 {
+		return 0
+	}
+	return t.clk().Now().Sub(time.Unix(0, last))
+}
+
+/*BytesRead returns how many bytes have been read off the wire, pings, unsolicited data and all.  It is a
+total over every connection the Arbiter has made, kept across reconnects so it only ever grows, and counts
+bytes as received, before any wire codec*/
+func (t *tcp) BytesRead() uint64 {
+	return t.rxTotal.Load()
+}
+
+/*BytesWritten returns how many bytes have been written to the wire, counted as BytesRead is, and including
+any preamble, framing and continuation input*/
+func (t *tcp) BytesWritten() uint64 {
+	return t.txTotal.Load()
+}
+
+/*Snapshot gathers the Arbiter's health in one go, for admin and debug endpoints.  The state and buffer
+length are read by the runner itself between polls, so they are consistent with each other.  While the
+runner is in a SetStateObserver func, they are as of that call instead, so fn can call Snapshot too*/
+func (t *tcp) Snapshot() Snapshot {
+	s := Snapshot{
+		Connected:    t.alive.Load(),
+		RemoteAddr:   t.RemoteAddr(),
+		LastError:    t.LastError(),
+		StalledFor:   t.StalledFor(),
+		Queued:       t.QueueLen(),
+		Paused:       t.paused.Load(),
+		BytesRead:    t.BytesRead(),
+		BytesWritten: t.BytesWritten(),
+	}
+	if up := t.upAt.Load(); s.Connected && up != 0 {
+		s.Uptime = t.clk().Now().Sub(time.Unix(0, up))
+	}
+	t.cbMu.Lock()
+	s.Failures = t.cbFails
+	t.cbMu.Unlock()
+	if v := t.observed.Load(); v != nil { //the runner is busy in the observer, perhaps calling us
+		s.State, s.BufferLen = v.state, v.buffered
+		return s
+	}
+	read := make(chan bool)
+	select {
+	case t.peek <- func() {
+		s.State, s.BufferLen = t.state, t.ibuf.Len()
+		close(read)
+	}:
+		<-read
+	case <-t.exited(): //no runner to ask, so idle with nothing buffered
+	}
+	return s
+}
+
+/*LastError returns the transport error that has broken the connection, such as a read or write
+failure or the peer hanging up, without issuing a command.  It is nil while the connection is healthy.
+After a Close, it is whatever it was just before*/
+func (t *tcp) LastError() error {
+	if te := t.lastErr.Load(); te != nil {
+		return te
+	}
+	return nil //not a nil *TransportError
+}
+
+/*SetStateObserver has fn called with every state transition of the runner, between StateIdle,
+StateWaitingOnReply and StateResponseFormed, as a debugging aid.  fn is called from the runner, so
+must be quick and must not issue commands, though it may call Snapshot.  nil, the default, removes it*/
+func (t *tcp) SetStateObserver(fn func(from, to int)) {
+	t.observer.Store(fn) //a nil fn still has a type, so can be stored
+}
+
+/*SetCircuitBreaker makes Control fail fast with ErrCircuitOpen, without touching the connection, once
+failures commands in a row have failed.  After cooldown the next command is let through as a trial, and
+closes the circuit if it succeeds, or opens it for another cooldown if not.  failures <= 0, the default,
+turns the circuit breaker off.  Calling it resets the count of failures*/
+func (t *tcp) SetCircuitBreaker(failures int, cooldown time.Duration) {
+	t.cbMu.Lock()
+	defer t.cbMu.Unlock()
+	t.cbLimit, t.cbWait, t.cbFails = failures, cooldown, 0
+}
+
+//circuitOpen reports if the circuit breaker is rejecting commands
+func (t *tcp) circuitOpen() bool {
+	t.cbMu.Lock()
+	defer t.cbMu.Unlock()
+	return t.cbLimit > 0 && t.cbFails >= t.cbLimit && t.clk().Now().Sub(t.cbOpen) < t.cbWait
+}
+
+//tally counts a command's outcome towards the circuit breaker
+func (t *tcp) tally(err error) {
+	t.cbMu.Lock()
+	defer t.cbMu.Unlock()
+	if err == nil {
+		t.cbFails = 0
+		return
+	}
+	if t.cbFails++; t.cbLimit > 0 && t.cbFails >= t.cbLimit { //open, or reopen after a failed trial
+		t.cbOpen = t.clk().Now()
+	}
+}
+
+//cached is a Response kept for Command.CacheTTL
+type cached struct {
+	resp Response
+	at   time.Time //when it was received
+}
+
+//cacheKey identifies a command and its formed bytes in the cache
+func cacheKey(cmd Command, b []byte) string {
+	return cmd.Name + "\x00" + string(b)
+}
+
+//cached returns the cached Response for cmd sent as b, if it has a CacheTTL and there is one still fresh
+func (t *tcp) cached(cmd Command, b []byte) (Response, bool) {
+	if cmd.CacheTTL <= 0 {
+		return Response{}, false
+	}
+	c, ok := t.cache.Load(cacheKey(cmd, b))
+	if !ok || t.clk().Now().Sub(c.(cached).at) >= cmd.CacheTTL {
+		return Response{}, false
+	}
+	r := c.(cached).resp
+	r.Bytes = append([]byte(nil), r.Bytes...) //callers may scribble on it
+	return r, true
+}
+
+/*CacheClear drops every Response cached for Command.CacheTTL, such as after a state change on the device
+that invalidates them.  Dial also clears the cache, as it may be talking to a different device*/
+func (t *tcp) CacheClear() {
+	t.cache.Clear()
+}
+
+/*Probe issues the ping command given to Dial and returns how long it took, along with any error.  It
+goes through Control like any other command*/
+func (t *tcp) Probe() (time.Duration, error) {
+	resp := t.Control(t.ping)
+	return resp.Duration, resp.Error
+}
+
+/*SetNoDelay controls TCP_NODELAY on connections made by subsequent Dials.  It is on by default, as
+Nagle's algorithm can add tens of milliseconds to each small command/response exchange.  It is ignored
+if the connection is not a *net.TCPConn*/
+func (t *tcp) SetNoDelay(noDelay bool) {
+	t.nagle = !noDelay
+}
+
+/*SetInterByteDelay paces requests for slow devices that drop characters sent back to back, writing them a
+byte at a time d apart rather than in a single write.  The runner sends each byte as it polls, so replies
+are still read and Close is not held up meanwhile, and gaps shorter than its 1ms poll are rounded up to it.
+The pacing counts against the command's Timeout, and what is still unsent when it runs out is dropped and
+the command fails with ErrTimeout.  Continuation input is paced the same way.  d <= 0, the default, turns
+pacing off*/
+func (t *tcp) SetInterByteDelay(d time.Duration) {
+	t.gap.Store(int64(d))
+}
+
+/*SetFallbackDelay tunes the Happy Eyeballs (RFC 6555) dialing used when the "tcp" network resolves to both
+IPv4 and IPv6 addresses.  The preferred family is dialed first, and if it has not connected after d, the
+other is dialed alongside it.  Whichever connects first is used, and the loser is cancelled and closed.  d of
+0 keeps Go's default of 300ms, and d < 0 disables the fallback, so only the preferred family is tried.  It
+applies to subsequent Dials, and does nothing for "tcp4", "tcp6", or NewVia and NewConn Arbiters*/
+func (t *tcp) SetFallbackDelay(d time.Duration) {
+	t.fallback = d
+}
+
+//Capabilities implements Arbiter.Capabilities
+func (t *tcp) Capabilities() Capabilities {
+	if t.network != "" && !strings.HasPrefix(t.network, "tcp") { //TCP_NODELAY is TCP only
+		return CapHalfDuplex | CapEOFDetection
+	}
+	return CapHalfDuplex | CapEOFDetection | CapNoDelay
+}
+
+//tapped is a chunk of wire traffic headed for a Tap
+type tapped struct {
+	at  time.Time
+	dir byte //'>' for sent, '<' for received, '!' for chunks dropped
+	b   []byte
+}
+
+//lostTap is the Tap record for n chunks dropped
+func lostTap(at time.Time, n uint64) tapped {
+	return tapped{at: at, dir: '!', b: strconv.AppendUint(nil, n, 10)}
+}
+
+/*Tap mirrors all traffic on the wire, in both directions, to w.  Each chunk written or read is
+recorded as a header line of the form
+
+	<RFC3339Nano timestamp> <'>' for sent or '<' for received> <length>
+
+followed by exactly length raw bytes and a newline.  w is written from its own goroutine so a slow w
+never holds up the runner.  Should w fall 256 chunks behind, further chunks are dropped until it catches
+up, and a record with '!' in place of the direction is written in their place, whose bytes are how many
+chunks were dropped in decimal.  Tapping again replaces w*/
+func (t *tcp) Tap(w io.Writer) {
+	t.Untap()
+	c, done := make(chan tapped, 256), make(chan bool)
+	go func() {
+		for r := range c {
+			fmt.Fprintf(w, "%s %c %d\n", r.at.Format(time.RFC3339Nano), r.dir, len(r.b))
+			w.Write(append(r.b, '\n'))
+		}
+		close(done)
+	}()
+	t.tapMu.Lock()
+	t.tapc, t.tapDone, t.tapLost = c, done, 0
+	t.tapMu.Unlock()
+}
+
+//Untap stops mirroring traffic, and returns once everything tapped so far has been written
+func (t *tcp) Untap() {
+	t.tapMu.Lock()
+	c, done, lost := t.tapc, t.tapDone, t.tapLost
+	t.tapc, t.tapDone = nil, nil
+	t.tapMu.Unlock()
+	if c != nil {
+		if lost > 0 { //the runner no longer sends on c, so waiting on the writer is fine
+			c <- lostTap(t.clk().Now(), lost)
+		}
+		close(c)
+		<-done
+	}
+}
+
+//tap hands b to the Tap and transcript, if there are any
+func (t *tcp) tap(dir byte, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	t.tapMu.Lock()
+	if t.tapc != nil { //never wait on the writer, drop and count instead
+		now := t.clk().Now()
+		if t.tapLost > 0 {
+			select {
+			case t.tapc <- lostTap(now, t.tapLost):
+				t.tapLost = 0
+			default:
+			}
+		}
+		sent := false
+		if t.tapLost == 0 {
+			select {
+			case t.tapc <- tapped{at: now, dir: dir, b: append([]byte(nil), b...)}:
+				sent = true
+			default:
+			}
+		}
+		if !sent {
+			t.tapLost++
+		}
+	}
+	t.tapMu.Unlock()
+	t.record(dir, b)
+}
+
+/*SetTranscript has everything that flows over the connection from now on, both ways, kept in memory for
+Transcript, up to the last max bytes.  Oldest records are dropped whole to make room.  Each Dial starts a
+fresh transcript.  max <= 0, the default, turns it off and drops any transcript so far*/
+func (t *tcp) SetTranscript(max int) {
+	t.trMu.Lock()
+	defer t.trMu.Unlock()
+	t.trMax = max
+	t.trim()
+}
+
+/*Transcript returns the transcript kept since SetTranscript, or since Dial if later, in the same format as
+Tap: a header line per chunk of
+
+	<RFC3339Nano timestamp> <'>' for sent or '<' for received> <length>
+
+followed by exactly length raw bytes and a newline*/
+func (t *tcp) Transcript() []byte {
+	t.trMu.Lock()
+	defer t.trMu.Unlock()
+	return bytes.Join(t.trLog, nil)
+}
+
+//record adds b to the transcript, if it is on
+func (t *tcp) record(dir byte, b []byte) {
+	t.trMu.Lock()
+	defer t.trMu.Unlock()
+	if t.trMax <= 0 {
+		return
+	}
+	rec := fmt.Appendf(nil, "%s %c %d\n", t.clk().Now().Format(time.RFC3339Nano), dir, len(b))
+	rec = append(append(rec, b...), '\n')
+	t.trLog = append(t.trLog, rec)
+	t.trSize += len(rec)
+	t.trim()
+}
+
+//trim drops the oldest transcript records until it is within trMax.  trMu must be held
+func (t *tcp) trim() {
+	for len(t.trLog) > 0 && t.trSize > t.trMax {
+		t.trSize -= len(t.trLog[0])
+		t.trLog = t.trLog[1:]
+	}
+}
+
+/*SetDryRun turns dry run mode on or off, for checking a script of commands offline.  While it is on,
+Control and its variants form each command with Command.Bytes and return straight away with the formed
+bytes in Response.Sent and any error from Bytes, such as ErrBytesArgs, in Response.Error.  Nothing is
+written to the wire, the Arbiter need not be connected, and Response.Bytes is empty*/
+func (t *tcp) SetDryRun(on bool) {
+	t.dryRun.Store(on)
+}
+
+/*Pause causes Control to reject new commands with ErrPaused, leaving the connection and runner up.
+A command already in flight is allowed to complete.*/
+func (t *tcp) Pause() {
+	t.paused.Store(true)
+}
+
+//Resume undoes Pause, and commands are accepted again
+func (t *tcp) Resume() {
+	t.paused.Store(false)
+}
+
 /* sock2ibuf reads data off the socket and shovels them into our buffer.  This is only called
 from within the go-routine to serialize access to the internal structures */
 func (t *tcp) sock2ibuf() {
 	b := make([]byte, 1024)
-	t.conn.SetReadDeadline(time.Now().Add(time.Duration(1) * time.Millisecond)) //dont wait here
-	n, err := t.conn.Read(b)                                                    //only reads up to the size of b
+	wait := time.Duration(1) * time.Millisecond //dont wait here
+	if t.state == waitingOnReply && t.request.Command.ReadWait > wait && len(t.paced) == 0 {
+		wait = t.request.Command.ReadWait
+		if left := t.deadline().Sub(t.clk().Now()); left < wait { //dont sleep through the timeout
+			wait = max(left, time.Millisecond)
+		}
+	}
+	t.conn.SetReadDeadline(time.Now().Add(wait))
+	n, err := t.conn.Read(b) //only reads up to the size of b
+	t.rxTotal.Add(uint64(n))
 	//bytes to  buffer
-	t.ibuf.Write(b[0:n])
+	t.tap('<', b[0:n])
+	chunk := b[0:n]
+	if w, _ := t.wire.Load().(wireCodec); w.dec != nil && n > 0 {
+		chunk = w.dec(chunk)
+	}
+	waking := t.state == waitingOnReply && t.clk().Now().Sub(t.reqTime) < t.request.Command.IgnoreFor
+	if !waking { //anything sooner is wake up noise, see Command.IgnoreFor
+		t.ibuf.Write(chunk)
+	}
+	if n > 0 && t.state == waitingOnReply && !waking {
+		if t.request.feed != nil && len(chunk) > 0 {
+			t.request.feed.put(chunk)
+		}
+		if t.rxTime.IsZero() {
+			t.rxTime = t.clk().Now()
+		}
+		t.progress.Store(t.clk().Now().UnixNano())
+		t.reads++
+		t.rxBytes += n
+	}
 	if toerr, ok := err.(net.Error); ok && toerr.Timeout() {
-		t.err = nil
+		if t.err != nil {
+			t.err = nil
+			t.lastErr.Store(nil)
+		}
 	} else if err != nil {
-		t.err = err
+		t.fail(err)
 	}
-	t.err = nil
 }
 
 /*checkState checks the various pass and fail conditions*/
@@ -160,31 +1386,163 @@ func (t *tcp) checkState() (Response, int) {
 		//check if we need to send a response.  This happens by a timeout or a match
 		alterResp := func(e error, by []byte) {
 			t.response.Error = e
-			t.response.Bytes = by
-			t.response.Duration = time.Since(t.reqTime)
-			t.state = responseFormed //tell goroutine we got a response they can handle
+			t.response.Bytes = append([]byte(nil), by...) //the next command, maybe an async one, reuses ibuf
+			t.response.Duration = t.clk().Now().Sub(t.reqTime)
+			t.response.Slow = t.request.Command.SoftTimeout > 0 && t.response.Duration > t.request.Command.SoftTimeout
+			t.response.FirstByteLatency = 0
+			t.response.ReadCount, t.response.TotalRead = t.reads, t.rxBytes
+			if !t.rxTime.IsZero() {
+				t.response.FirstByteLatency = t.rxTime.Sub(t.reqTime)
+			}
+			t.paced = nil //whatever is left of the request is moot now
+			t.progress.Store(0)
+			t.setState(responseFormed) //tell goroutine we got a response they can handle
+		}
+
+		deadline := t.deadline()
+		expired := t.clk().Now().After(deadline)
+		if ctx := t.request.ctx; ctx != nil && ctx.Err() != nil { //context done, unless Timeout ran out first
+			if d, ok := ctx.Deadline(); !expired || ok && d.Before(deadline) {
+				alterResp(ctx.Err(), t.ibuf.Bytes())
+				return t.response, t.state
+			}
 		}
 
-		if time.Now().Sub(t.reqTime) > t.request.Command.Timeout { //timeout
-			alterResp(ErrTimeout, t.ibuf.Bytes())
+		if expired { //timeout, the peer is gone and there never was a reply coming, or silence or no fault was the reply
+			if b, ok := t.request.Command.untrailed(t.ibuf.Bytes()); ok && t.err == nil && len(t.paced) == 0 {
+				alterResp(nil, b) //only the Trailer is missing, the reply itself is good
+				return t.response, t.state
+			}
+			var e error
+			switch {
+			case t.err != nil: //say why, as well as that the peer is gone
+				e = fmt.Errorf("%w: %w", ErrNotConnected, t.err)
+			case len(t.paced) > 0: //the request never got out in full
+				e = ErrTimeout
+			case t.request.Command.NegativeConfirm: //no fault seen
+			case t.ibuf.Len() > 0 || !t.request.Command.SilenceIsSuccess:
+				e = ErrTimeout
+			}
+			alterResp(e, t.ibuf.Bytes())
 			return t.response, t.state
 		}
 
-		if t.request.Command.Error.Match(t.ibuf.Bytes()) { //Check for Failure Match
-			alterResp(ErrMatch, t.ibuf.Bytes())
+		if buf := t.ibuf.Bytes(); !t.request.Command.mayMatch(buf, t.scanAt) { //nothing new worth a full match
+			t.scanAt = len(buf)
+		} else if b, formed, err := t.request.Command.match(buf); formed { //Check for Failure or Success Match
+			alterResp(err, b)
 			return t.response, t.state
 		}
 
-		if t.request.Command.Response.Match(t.ibuf.Bytes()) { //Check for Success Match
-			alterResp(nil, t.request.Command.Response.Find(t.ibuf.Bytes()))
+		if max := t.request.Command.MaxResponseBytes; max > 0 && t.ibuf.Len() > max { //flooded
+			alterResp(ErrResponseTooLarge, t.ibuf.Bytes()[:max])
 			return t.response, t.state
 		}
 
+		t.continueReply()
+
 		fmt.Sprintf("")
 	}
 	return t.response, t.state
 }
 
+//deadline returns when the request in flight times out
+func (t *tcp) deadline() time.Time {
+	if !t.request.deadline.IsZero() {
+		return t.request.deadline
+	}
+	return t.reqTime.Add(t.request.Command.Timeout)
+}
+
+//runnerView is the runner's state and buffer length, handed to Snapshot
+type runnerView struct {
+	state    int
+	buffered int
+}
+
+//setState moves the runner to state s, telling any state observer
+func (t *tcp) setState(s int) {
+	from := t.state
+	t.state = s
+	if fn, _ := t.observer.Load().(func(from, to int)); fn != nil {
+		t.observed.Store(&runnerView{state: s, buffered: t.ibuf.Len()})
+		fn(from, s)
+		t.observed.Store(nil)
+	}
+}
+
+//fail records err from the connection as t.err, and in the history returned by Close
+func (t *tcp) fail(err error) {
+	t.finish()
+	te := &TransportError{Err: err}
+	if _, held := t.err.(*TransportError); !held { //keep the cause, not the EOF every read after it returns
+		t.err = te
+		t.lastErr.Store(te)
+	}
+	if n := len(t.errs); n == 0 || t.errs[n-1].Error() != err.Error() { //dont repeat the EOF seen every poll
+		t.errs = append(t.errs, t.err)
+	}
+}
+
+//continueReply sends the ContinuationInput for each new ContinuationPattern prompt in the reply so far
+func (t *tcp) continueReply() {
+	cmd := t.request.Command
+	if cmd.ContinuationPattern == nil {
+		return
+	}
+	for t.err == nil {
+		loc := cmd.ContinuationPattern.FindIndex(t.ibuf.Bytes()[t.contAt:])
+		if loc == nil {
+			return
+		}
+		t.contAt += loc[1]
+		if err := t.write(t.encode([]byte(cmd.ContinuationInput))); err != nil {
+			t.fail(err)
+		}
+	}
+}
+
+/*write puts b on the wire.  With SetInterByteDelay, only its first byte goes now, if due, and the rest
+is left for pace*/
+func (t *tcp) write(b []byte) error {
+	if t.gap.Load() > 0 && (len(b) > 1 || len(t.paced) > 0) {
+		t.paced = append(t.paced, b...)
+		return t.pace()
+	}
+	return t.writeAll(b)
+}
+
+//pace writes the next paced byte if it is due, and is called by the runner every poll
+func (t *tcp) pace() error {
+	if len(t.paced) == 0 || t.clk().Now().Before(t.paceAt) {
+		return nil
+	}
+	b := t.paced[:1]
+	t.paced = t.paced[1:]
+	t.paceAt = t.clk().Now().Add(time.Duration(t.gap.Load()))
+	return t.writeAll(b)
+}
+
+/*writeAll puts all of b on the wire, looping over short writes until everything is written or an error
+occurs.  Any deadline set on the connection still applies to every underlying Write.  A Write that makes
+no progress without reporting an error is treated as io.ErrShortWrite rather than spinning forever*/
+func (t *tcp) writeAll(b []byte) error {
+	for { //always Write at least once, so even an empty request detects a dead connection
+		n, err := t.conn.Write(b)
+		t.txTotal.Add(uint64(n))
+		t.tap('>', b[:n])
+		if err != nil {
+			return err
+		}
+		if b = b[n:]; len(b) == 0 {
+			return nil
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+}
+
 func (t *tcp) handleIncoming(r request) {
 	if t.state != idle { //Busy
 		resp := Response{Bytes: []byte(""), Error: ErrBusy}
@@ -194,48 +1552,96 @@ func (t *tcp) handleIncoming(r request) {
 		t.sresp <- resp
 		return
 	}
-	t.ibuf.Truncate(0)                               //clear out internal buffer
-	if _, err := t.conn.Write(r.bytes); err != nil { //write request onto the wire
-		t.err = err //connection broken
-		t.sresp <- Response{Bytes: []byte(""), Error: err}
+	t.ibuf.Truncate(0) //clear out internal buffer
+	out := r.bytes
+	if r.Command.Codec != nil {
+		out = r.Command.Codec.Encode(out)
+	}
+	out = t.encode(out)
+	if pre, _ := t.preamble.Load().([]byte); len(pre) > 0 { //one write, so the preamble cannot be split off
+		out = append(pre[:len(pre):len(pre)], out...)
+	}
+	t.paced = nil
+	if err := t.write(out); err != nil { //write request onto the wire
+		t.fail(err) //connection broken
+		t.sresp <- Response{Bytes: []byte(""), Error: t.err}
 		return
 	}
 	t.request = r
-	t.reqTime = time.Now()
-	t.state = waitingOnReply
+	if r.Command.EchoConfirm { //the echo of what went out is the confirmation
+		t.request.Command.ResponseLiteral = string(r.bytes)
+	}
+	t.reqTime = t.clk().Now()
+	t.progress.Store(t.reqTime.UnixNano())
+	t.rxTime = time.Time{}
+	t.reads, t.rxBytes = 0, 0
+	t.contAt, t.scanAt = 0, 0
+	t.setState(waitingOnReply)
+}
+
+/*abandon hands the caller of a command cut short by Close a final Response, so it is not left waiting on
+a runner that is going away, and leaves the runner idle for the next connection.  A reply already formed
+is delivered as is, and one still awaited fails with ErrNotConnected.  Should the caller not be ready to
+take it, it still sees the runner exit*/
+func (t *tcp) abandon() {
+	if t.state == idle {
+		return
+	}
+	r := t.response
+	if t.state == waitingOnReply {
+		r = Response{Bytes: []byte(""), Error: ErrNotConnected, Duration: t.clk().Now().Sub(t.reqTime)}
+	}
+	select {
+	case t.sresp <- r:
+	default:
+	}
+	t.paced = nil
+	t.progress.Store(0)
+	t.setState(idle)
 }
 
 /*runner is called as a go-routine internally*/
 func (t *tcp) runner(setup chan<- bool) {
-	t.alive = true
+	runners.Add(1)
+	t.alive.Store(true)
 	//We are really up.  Start the background goroutine stuffs
 
-	t.stop = make(chan error)
-	t.tick = time.NewTicker(time.Duration(1) * time.Millisecond) //poll for crap every 20ms
-	t.sreq = make(chan request)
-	t.sresp = make(chan Response)
+	d, _ := t.done.Load().(*connDone)
+	t.errs = nil
+	t.tick = t.clk().NewTicker(time.Duration(1) * time.Millisecond) //poll for crap every 20ms
+	conn, tick := t.conn, t.tick                                    //ours, even if a later Dial replaces the fields
+	for n := len(t.sreq); n > 0; n-- {                              //left by a caller that raced the last connection closing
+		<-t.sreq
+	}
+	for n := len(t.sresp); n > 0; n-- {
+		<-t.sresp
+	}
 
 	//start background go routine to poll for data
 	setup <- true
 
-	defer func() {
-		t.conn.Close() //kill network connection
-		t.tick.Stop()  //GC stop ticker
-
-		close(t.sreq)
-		close(t.sresp)
-		t.alive = false //done elsewhere as well, but just a failsafe
-	}()
-
 	for { //loop until we are told to stop
 		select { //block
-		case <-t.tick.C: //tick for checking for more data off the socket
+		case <-t.tick.C(): //tick for checking for more data off the socket
+			if err := t.pace(); err != nil {
+				t.fail(err)
+			}
 			t.sock2ibuf()
 		case r := <-t.sreq: //Incoming request or command.
 			t.handleIncoming(r)
+		case fn := <-t.peek:
+			fn()
 		case <-t.stop:
-			t.alive = false //make sure we set this syncronously before we give up
-			t.stop <- nil   //signal back we are done
+			t.alive.Store(false) //make sure we set this syncronously before we give up
+			if err := conn.Close(); err != nil {
+				t.errs = append(t.errs, err)
+			}
+			tick.Stop()
+			t.abandon()
+			d.once.Do(func() { close(d.ch) }) //torn down before Close returns, so a quick redial is left alone
+			close(d.exited)
+			runners.Add(-1)                  //counted out before Close returns
+			t.stop <- errors.Join(t.errs...) //signal back we are done
 			return
 		}
 		t.checkState() //force checking state (timeout, errors, or command data matches)
@@ -243,7 +1649,7 @@ func (t *tcp) runner(setup chan<- bool) {
 		if t.state == responseFormed {
 			select {
 			case t.sresp <- t.response: //send response if requested
-				t.state = idle //finished sending
+				t.setState(idle) //finished sending
 			default:
 			}
 
@@ -26,11 +26,21 @@ SOFTWARE.
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -99,8 +109,12 @@ func HandleRequest(conn net.Conn) {
 			conn.Write([]byte("ok"))
 			conn.Close() // Close the connection when you're done with it.
 			return
-		case "close-evil": //close connection nicely
+		case "close-evil": //reset the connection, as a crash would
 			conn.Write([]byte("ok"))
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetLinger(0)
+			}
+			conn.Close()
 			return
 		}
 		if _, err := conn.Write(buf); err != nil {
@@ -130,6 +144,13 @@ func TcpServer() {
 
 func TestMain(m *testing.M) {
 	go TcpServer()
+	for i := 0; i < 100; i++ { //wait for the simulator to be listening
+		if conn, err := net.Dial("tcp", dial); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
 	os.Exit(m.Run())
 }
 
@@ -140,7 +161,7 @@ func TestTcp_Close(t *testing.T) {
 		t.Fatalf("Close should return immediately if not started")
 	}
 
-	tcp.alive = true
+	tcp.alive.Store(true)
 	//allow timeout
 	go func() { <-tcp.stop }()
 	if tcp.Close() != ErrTimeout {
@@ -159,8 +180,8 @@ func TestTcp_Close(t *testing.T) {
 
 func TestTcp_Dial(t *testing.T) {
 	tcp_ := new(tcp)
-	if e := tcp_.Dial("host-does-not-exist:65537", 100*time.Millisecond, pingOk); e == nil {
-		t.Fatalf("Invalid Hostname and port should fail dial")
+	if e := tcp_.Dial("host-does-not-exist:65537", 100*time.Millisecond, pingOk); !errors.Is(e, ErrConnectFailed) || errors.Is(e, ErrPingFailed) || !errors.Is(e, ErrTransport) {
+		t.Fatalf("Invalid Hostname and port should fail dial with ErrConnectFailed: %v", e)
 	}
 	tcp_.Close()
 
@@ -185,8 +206,8 @@ func TestTcp_Dial(t *testing.T) {
 	tcp_.Close()
 
 	tcp_ = new(tcp)
-	if e := tcp_.Dial(dial, 100*time.Millisecond, pingBad); e == nil {
-		t.Fatalf("Dial should  fail with bad ping")
+	if e := tcp_.Dial(dial, 100*time.Millisecond, pingBad); !errors.Is(e, ErrPingFailed) || !errors.Is(e, ErrTimeout) {
+		t.Fatalf("Dial should  fail with bad ping: %v", e)
 	}
 	tcp_.Close()
 }
@@ -200,7 +221,7 @@ func TestTcp_Control(t *testing.T) {
 		t.Fatalf("When in unstarted state, should fail")
 	}
 
-	tcp_.alive = true
+	tcp_.alive.Store(true)
 
 	if resp := tcp_.Control(pingWrong); resp.Error != ErrBytesArgs {
 		t.Fatalf("Not feeding requied arg should produce an error")
@@ -382,8 +403,8 @@ func TestTcp_handleIncoming(t *testing.T) {
 	select {
 	case resp = <-tc.sresp:
 	}
-	if resp.Error == nil {
-		t.Errorf("Should not be able to write to closed socket")
+	if !errors.Is(resp.Error, ErrTransport) || !errors.Is(resp.Error, net.ErrClosed) {
+		t.Errorf("Should not be able to write to closed socket: %v", resp.Error)
 	}
 }
 
@@ -428,3 +449,2720 @@ func TestTcp_handleIncoming(t *testing.T) {
 // 	tt.Close()
 // 	fmt.Println("Closing Socket")
 // }
+
+/*socksServer is a bare-bones, no-auth, CONNECT-only SOCKS5 proxy used to test NewVia.  It returns
+the address it is listening on*/
+func socksServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to start socks server: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				buf := make([]byte, 262)
+				if _, err := io.ReadFull(c, buf[:2]); err != nil { //version, nmethods
+					return
+				}
+				if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+					return
+				}
+				c.Write([]byte{5, 0}) //no auth
+				if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[1] != 1 {
+					return
+				}
+				var host string
+				switch buf[3] {
+				case 1: //ipv4
+					io.ReadFull(c, buf[:4])
+					host = net.IP(buf[:4]).String()
+				case 3: //domain name
+					io.ReadFull(c, buf[:1])
+					io.ReadFull(c, buf[1:1+buf[0]])
+					host = string(buf[1 : 1+buf[0]])
+				default:
+					return
+				}
+				io.ReadFull(c, buf[:2])
+				port := int(buf[0])<<8 | int(buf[1])
+				remote, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprint(port)))
+				if err != nil {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer remote.Close()
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(remote, c)
+				io.Copy(c, remote)
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestNewVia(t *testing.T) {
+	a := NewVia(socksServer(t))
+	if e := a.Dial(dial, 500*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Dial through proxy should succeed: %v", e)
+	}
+	if resp := a.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Control through proxy should succeed: %v", resp)
+	}
+	a.Close()
+
+	a = NewVia("localhost:1") //nothing listening
+	if e := a.Dial(dial, 100*time.Millisecond, pingOk); e == nil {
+		t.Fatalf("Dial through unreachable proxy should fail")
+	}
+}
+
+func TestTcp_ChannelDepth(t *testing.T) {
+	defer func(d int) { ChannelDepth = d }(ChannelDepth)
+	for _, depth := range []int{0, 1, 4} {
+		ChannelDepth = depth
+		tc := new(tcp)
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial should succeed with ChannelDepth %d: %v", depth, e)
+		}
+		if cap(tc.sreq) != depth || cap(tc.sresp) != depth {
+			t.Errorf("Channels not created with depth %d", depth)
+		}
+		if resp := tc.Control(pingOk); resp.Error != nil {
+			t.Errorf("Control should succeed with ChannelDepth %d: %v", depth, resp)
+		}
+		tc.Close()
+	}
+}
+
+func TestTcp_TryControl(t *testing.T) {
+	tc := new(tcp)
+	if _, ok := tc.TryControl(pingOk); ok {
+		t.Fatalf("TryControl should not run when not connected")
+	}
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	if resp, ok := tc.TryControl(pingOk); !ok || resp.Error != nil {
+		t.Fatalf("TryControl should run when idle: %v %v", ok, resp)
+	}
+
+	done := make(chan Response)
+	go func() { done <- tc.Control(pingBad) }() //holds the arbiter until it times out
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := tc.TryControl(pingOk); ok {
+		t.Fatalf("TryControl should not run while another command is in flight")
+	}
+	if resp := <-done; resp.Error != ErrTimeout {
+		t.Fatalf("Slow command should have timed out: %v", resp)
+	}
+	if _, ok := tc.TryControl(pingOk); !ok {
+		t.Fatalf("TryControl should run once idle again")
+	}
+}
+
+func TestTcp_checkStateExtract(t *testing.T) {
+	tc := new(tcp)
+	tc.request.Command = Command{
+		Name:     "extract",
+		Timeout:  5 * time.Second,
+		Response: regexp.MustCompile(`v=([0-9]+)\n`),
+		Error:    regexp.MustCompile("a^"),
+	}
+	check := func(want string) {
+		tc.ibuf.Reset()
+		tc.ibuf.WriteString("junk v=42\n")
+		tc.reqTime = time.Now()
+		tc.state = waitingOnReply
+		if resp, state := tc.checkState(); resp.Error != nil || state != responseFormed || string(resp.Bytes) != want {
+			t.Errorf("checkState() extracted %q (%v), wanted %q", resp.Bytes, resp.Error, want)
+		}
+	}
+	check("v=42\n") //default is Find
+
+	tc.request.Command.Extract = func(re *regexp.Regexp, buf []byte) []byte {
+		return re.FindSubmatch(buf)[1]
+	}
+	check("42")
+}
+
+//shortConn is a net.Conn that only ever writes up to max bytes per Write, without an error
+type shortConn struct {
+	net.Conn
+	max    int
+	writes int
+}
+
+func (s *shortConn) Write(b []byte) (int, error) {
+	s.writes++
+	if len(b) > s.max {
+		b = b[:s.max]
+	}
+	return s.Conn.Write(b)
+}
+
+func TestTcp_write(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	got := make(chan []byte)
+	go func() {
+		b, _ := io.ReadAll(server)
+		got <- b
+	}()
+
+	sc := &shortConn{Conn: client, max: 3}
+	tc := &tcp{conn: sc}
+	want := []byte("a rather long command that needs several writes\r")
+	if err := tc.writeAll(want); err != nil {
+		t.Fatalf("Short writes should not produce an error: %v", err)
+	}
+	client.Close()
+	if b := <-got; !bytes.Equal(b, want) {
+		t.Fatalf("Command was truncated by short writes: got %q", b)
+	}
+	if sc.writes < len(want)/sc.max {
+		t.Fatalf("Expected multiple short writes, got %d", sc.writes)
+	}
+
+	sc = &shortConn{Conn: client, max: 0}
+	tc.conn = sc
+	if err := tc.writeAll(want); err == nil {
+		t.Fatalf("Writing to a closed/stalled connection should error")
+	}
+}
+
+func TestTcp_SetInterByteDelay(t *testing.T) {
+	reads := make(chan int, 1)
+	tc := pipeTcp(t, func(conn net.Conn) { //counts the reads it takes to get each request, then answers
+		buf := make([]byte, 64)
+		for {
+			n, req := 0, []byte{}
+			for !bytes.HasSuffix(req, []byte("\r")) {
+				k, err := conn.Read(buf)
+				if err != nil {
+					return
+				}
+				n, req = n+1, append(req, buf[:k]...)
+			}
+			reads <- n
+			conn.Write(req)
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "slow",
+		Timeout:       time.Second,
+		Prototype:     "HELLO\r",
+		CommandRegexp: regexp.MustCompile(`^HELLO\r$`),
+		Response:      regexp.MustCompile(`HELLO\r`),
+	}
+	if r := tc.Control(cmd); r.Error != nil || <-reads != 1 {
+		t.Fatalf("Requests should go in a single write by default: %v", r)
+	}
+	tc.SetInterByteDelay(5 * time.Millisecond)
+	then := time.Now()
+	if r := tc.Control(cmd); r.Error != nil || <-reads != len("HELLO\r") {
+		t.Fatalf("Requests should be written a byte at a time: %v", r)
+	}
+	if took := time.Since(then); took < 5*5*time.Millisecond {
+		t.Errorf("Bytes should be spaced out, but the request took only %v", took)
+	}
+	cmd.Timeout = 10 * time.Millisecond
+	if r := tc.Control(cmd); r.Error != ErrTimeout {
+		t.Errorf("Pacing should not run past the Timeout: %v", r)
+	}
+	cmd.Timeout = time.Second
+	if r := tc.Control(cmd); r.Error != nil {
+		t.Errorf("Running out of time while pacing should not cost the connection: %v", r)
+	}
+	<-reads
+
+	tc.SetInterByteDelay(30 * time.Millisecond) //about 150ms to send
+	done := make(chan Response, 1)
+	go func() { done <- tc.Control(cmd) }()
+	time.Sleep(20 * time.Millisecond)
+	then = time.Now()
+	if s := tc.Snapshot(); s.State != StateWaitingOnReply || time.Since(then) > 20*time.Millisecond {
+		t.Errorf("Snapshot should not wait out the pacing: %+v after %v", s, time.Since(then))
+	}
+	if e := tc.Close(); e != nil {
+		t.Errorf("Close should not wait out the pacing: %v", e)
+	}
+	if r := <-done; r.Error != ErrNotConnected {
+		t.Errorf("Closing mid request should fail it: %v", r)
+	}
+}
+
+func TestTcp_SetDryRun(t *testing.T) {
+	tc := new(tcp) //never connected
+	tc.SetDryRun(true)
+	set := Command{
+		Name:          "set",
+		Timeout:       time.Second,
+		Prototype:     "SET %d\r",
+		CommandRegexp: regexp.MustCompile(`^SET [1-9]\r$`),
+		Response:      regexp.MustCompile(`OK\r`),
+	}
+	if r := tc.Control(set, 5); r.Error != nil || string(r.Sent) != "SET 5\r" || len(r.Bytes) != 0 {
+		t.Errorf("Dry run should form the command without a connection: %v %q", r, r.Sent)
+	}
+	if r := tc.Control(set, 10); r.Error != ErrBytesFormat {
+		t.Errorf("Dry run should still validate against CommandRegexp: %v", r)
+	}
+	if r := tc.Control(set); r.Error != ErrBytesArgs {
+		t.Errorf("Dry run should still check the args: %v", r)
+	}
+	if r, ok := tc.TryControl(set, 3); !ok || r.Error != nil || string(r.Sent) != "SET 3\r" {
+		t.Errorf("TryControl should dry run too: %v %v", r, ok)
+	}
+
+	written := make(chan []byte, 1)
+	tc = pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			written <- append([]byte(nil), buf[:n]...)
+			conn.Write([]byte("OK\r"))
+		}
+	})
+	defer tc.Close()
+	tc.SetDryRun(true)
+	if r := tc.Control(set, 7); r.Error != nil || string(r.Sent) != "SET 7\r" {
+		t.Errorf("Dry run failed on a connected Arbiter: %v", r)
+	}
+	tc.SetDryRun(false)
+	if r := tc.Control(set, 8); r.Error != nil || string(r.Sent) != "SET 8\r" || string(r.Bytes) != "OK\r" {
+		t.Errorf("Sent should hold the request for real commands too: %v %q", r, r.Sent)
+	}
+	if b := <-written; string(b) != "SET 8\r" {
+		t.Errorf("Only the real command should reach the device, got %q", b)
+	}
+}
+
+func TestTcp_BytesReadWritten(t *testing.T) {
+	tc := new(tcp)
+	cmd := Command{
+		Name:          "hello",
+		Timeout:       time.Second,
+		Prototype:     "HELLO\r",
+		CommandRegexp: regexp.MustCompile(`^HELLO\r$`),
+		Response:      regexp.MustCompile(`OK\r`),
+	}
+	var wrote, read uint64
+	for i := 0; i < 2; i++ { //totals carry over a reconnect
+		client, server := net.Pipe()
+		go func() {
+			buf := make([]byte, 64)
+			for {
+				n, err := server.Read(buf)
+				if err != nil {
+					return
+				}
+				if string(buf[:n]) == "HELLO\r" {
+					server.Write([]byte("NOISE\rOK\r"))
+				} else {
+					server.Write(buf[:n])
+				}
+			}
+		}()
+		tc.dialer = func(string, time.Duration) (net.Conn, error) { return client, nil }
+		if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Unable to dial pipe: %v", e)
+		}
+		if r := tc.Control(cmd); r.Error != nil {
+			t.Fatalf("Control failed: %v", r)
+		}
+		tc.Close()
+		ping, _ := pingOk.Bytes()
+		wrote += uint64(3*len(ping) + len("HELLO\r"))
+		read += uint64(3*len(ping) + len("NOISE\rOK\r"))
+		if tc.BytesWritten() != wrote || tc.BytesRead() != read {
+			t.Errorf("After connection #%d: wrote %d read %d, want %d and %d", i, tc.BytesWritten(), tc.BytesRead(), wrote, read)
+		}
+	}
+	if s := tc.Snapshot(); s.BytesRead != read || s.BytesWritten != wrote {
+		t.Errorf("Snapshot should carry the totals: %+v", s)
+	}
+}
+
+func TestTcp_IgnoreFor(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //echoes, chatters while waking, then sends its reading
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+			conn.Write([]byte("T=00.0\r"))
+			time.Sleep(40 * time.Millisecond)
+			conn.Write([]byte("T=21.5\r"))
+		}
+	})
+	defer tc.Close()
+	wake := Command{
+		Name:          "wake",
+		Timeout:       200 * time.Millisecond,
+		Prototype:     "WAKE\r",
+		CommandRegexp: regexp.MustCompile(`^WAKE\r$`),
+		Response:      regexp.MustCompile(`T=[\d.]+\r`),
+	}
+	if r := tc.Control(wake); string(r.Bytes) != "T=00.0\r" {
+		t.Fatalf("Without IgnoreFor the wake up noise should match: %v", r)
+	}
+	time.Sleep(60 * time.Millisecond) //let the reading go by
+	wake.IgnoreFor = 20 * time.Millisecond
+	r := tc.Control(wake)
+	if r.Error != nil || string(r.Bytes) != "T=21.5\r" {
+		t.Errorf("IgnoreFor should skip the wake up noise: %v", r)
+	}
+	if r.Duration < 40*time.Millisecond {
+		t.Errorf("The reading should only have been taken once it arrived: %v", r.Duration)
+	}
+	time.Sleep(60 * time.Millisecond)
+	wake.IgnoreFor, wake.Timeout = 100*time.Millisecond, 80*time.Millisecond
+	if r := tc.Control(wake); !errors.Is(r.Error, ErrTimeout) {
+		t.Errorf("Timeout should cover IgnoreFor: %v", r)
+	}
+}
+
+func TestTcp_CloseMidFlight(t *testing.T) {
+	tc := new(tcp)
+	slow := Command{
+		Name:          "slow",
+		Timeout:       5 * time.Second,
+		Prototype:     "SLOW\r",
+		CommandRegexp: regexp.MustCompile(`^SLOW\r$`),
+		Response:      regexp.MustCompile(`DONE\r`),
+	}
+	for i := 0; i < 2; i++ { //and the next connection should not inherit the abandoned command
+		client, server := net.Pipe()
+		go func() { //answers pings, never the slow command
+			buf := make([]byte, 64)
+			for {
+				n, err := server.Read(buf)
+				if err != nil {
+					return
+				}
+				if string(buf[:n]) != "SLOW\r" {
+					server.Write(buf[:n])
+				}
+			}
+		}()
+		tc.dialer = func(string, time.Duration) (net.Conn, error) { return client, nil }
+		if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial #%d failed: %v", i, e)
+		}
+		if r := tc.Control(pingOk); r.Error != nil {
+			t.Fatalf("Control on connection #%d failed: %v", i, r)
+		}
+		got := make(chan Response)
+		go func() { got <- tc.Control(slow) }()
+		time.Sleep(20 * time.Millisecond)
+		then := time.Now()
+		tc.Close()
+		select {
+		case r := <-got:
+			if !errors.Is(r.Error, ErrNotConnected) {
+				t.Errorf("A command cut short by Close should fail with ErrNotConnected: %v", r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Control was left hanging by Close")
+		}
+		if took := time.Since(then); took > 200*time.Millisecond {
+			t.Errorf("Control should return promptly on Close, took %v", took)
+		}
+	}
+}
+
+func TestTcp_Pause(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	done := make(chan Response)
+	go func() { done <- tc.Control(pingBad) }() //in flight when paused
+	time.Sleep(20 * time.Millisecond)
+	tc.Pause()
+	if resp := tc.Control(pingOk); resp.Error != ErrPaused {
+		t.Fatalf("Paused arbiter should reject commands: %v", resp)
+	}
+	if resp := <-done; resp.Error != ErrTimeout {
+		t.Fatalf("In flight command should complete normally: %v", resp)
+	}
+
+	tc.Resume()
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Resumed arbiter should accept commands on the same connection: %v", resp)
+	}
+}
+
+func TestTcp_FirstByteLatency(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	resp := tc.Control(pingOk)
+	if resp.Error != nil || resp.FirstByteLatency <= 0 || resp.FirstByteLatency > resp.Duration {
+		t.Fatalf("FirstByteLatency should be within the Duration: %v %v", resp.FirstByteLatency, resp)
+	}
+	if resp = tc.Control(pingBad); resp.Error != ErrTimeout || resp.FirstByteLatency != 0 {
+		t.Fatalf("FirstByteLatency should be 0 when nothing arrived: %v %v", resp.FirstByteLatency, resp)
+	}
+}
+
+func TestTcp_checkStateLiteral(t *testing.T) {
+	tc := new(tcp)
+	tc.request.Command = Command{
+		Name:            "version",
+		Timeout:         5 * time.Second,
+		Response:        regexp.MustCompile("a^"),
+		Error:           regexp.MustCompile("a^"),
+		ResponseLiteral: "v1.2\r",
+		ErrorLiteral:    "ERR.",
+	}
+	tests := []struct {
+		in, out string
+		err     error
+		state   int
+	}{
+		{"ver v1x2\r", "", errUnformedResponse, waitingOnReply}, //'.' is not a wildcard
+		{"ver v1.2\r", "v1.2\r", nil, responseFormed},
+		{"ERRX", "", errUnformedResponse, waitingOnReply},
+		{"ERR.", "ERR.", ErrMatch, responseFormed},
+	}
+	for _, test := range tests {
+		tc.ibuf.Reset()
+		tc.ibuf.WriteString(test.in)
+		tc.reqTime = time.Now()
+		tc.state = waitingOnReply
+		resp, state := tc.checkState()
+		if resp.Error != test.err || state != test.state || (state == responseFormed && string(resp.Bytes) != test.out) {
+			t.Errorf("checkState() on %q: got %q %v %d", test.in, resp.Bytes, resp.Error, state)
+		}
+	}
+}
+
+func TestTcp_SetNoDelay(t *testing.T) {
+	for _, noDelay := range []bool{true, false} {
+		tc := new(tcp)
+		tc.SetNoDelay(noDelay)
+		if tc.nagle == noDelay {
+			t.Errorf("SetNoDelay(%v) not recorded", noDelay)
+		}
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial should succeed with SetNoDelay(%v): %v", noDelay, e)
+		}
+		tc.Close()
+	}
+
+	//non-tcp connections are left alone
+	client, server := net.Pipe()
+	defer server.Close()
+	go HandleRequest(server)
+	tc := NewConn(client).(*tcp)
+	if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Dial should succeed over a non-tcp connection: %v", e)
+	}
+	tc.Close()
+}
+
+func TestTcp_SetFallbackDelay(t *testing.T) {
+	for _, d := range []time.Duration{time.Millisecond, -1} {
+		tc := new(tcp)
+		tc.SetFallbackDelay(d)
+		if tc.fallback != d {
+			t.Errorf("SetFallbackDelay(%v) not recorded", d)
+		}
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial should succeed with SetFallbackDelay(%v): %v", d, e)
+		}
+		tc.Close()
+	}
+}
+
+func TestTcp_Probe(t *testing.T) {
+	tc := new(tcp)
+	if _, e := tc.Probe(); e != ErrNotConnected {
+		t.Fatalf("Probe should fail when not connected: %v", e)
+	}
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+	if d, e := tc.Probe(); e != nil || d <= 0 || d > pingOk.Timeout {
+		t.Fatalf("Probe should return a sane round trip time: %v %v", d, e)
+	}
+}
+
+func TestTcp_checkStateValidate(t *testing.T) {
+	tc := new(tcp)
+	tc.request.Command = Command{
+		Name:     "checksum",
+		Timeout:  5 * time.Second,
+		Response: regexp.MustCompile(`[0-9]+\*[0-9]\n`),
+		Error:    regexp.MustCompile("a^"),
+		Validate: func(b []byte) (bool, bool) { //last digit is the sum of the others mod 10
+			if bytes.HasPrefix(b, []byte("0")) {
+				return false, false //leading zero means the device is still warming up
+			}
+			sum := 0
+			for _, c := range b[:len(b)-3] {
+				sum += int(c - '0')
+			}
+			return sum%10 == int(b[len(b)-2]-'0'), true
+		},
+	}
+	tests := []struct {
+		in    string
+		err   error
+		state int
+	}{
+		{"123*6\n", nil, responseFormed},
+		{"123*7\n", ErrValidate, responseFormed},
+		{"023*5\n", errUnformedResponse, waitingOnReply},
+	}
+	for _, test := range tests {
+		tc.ibuf.Reset()
+		tc.ibuf.WriteString(test.in)
+		tc.reqTime = time.Now()
+		tc.state = waitingOnReply
+		if resp, state := tc.checkState(); resp.Error != test.err || state != test.state {
+			t.Errorf("checkState() on %q: got %v %d", test.in, resp.Error, state)
+		}
+	}
+}
+
+/*pipeTcp returns a dialed tcp whose connection is one end of a net.Pipe.  The other end answers the
+three Dial pings, and is then handed to device*/
+func pipeTcp(t *testing.T, device func(conn net.Conn)) *tcp {
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		buf := make([]byte, 64)
+		for i := 0; i < 3; i++ {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			server.Write(buf[:n])
+		}
+		device(server)
+	}()
+	tc := &tcp{dialer: func(string, time.Duration) (net.Conn, error) { return client, nil }}
+	if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Unable to dial pipe: %v", e)
+	}
+	return tc
+}
+
+func TestTcp_BuildCatalog(t *testing.T) {
+	var cat struct {
+		Temp Command `prototype:"TEMP?\r" regexp:"TEMP\\?\r" response:"[0-9.]+\r" timeout:"200ms"` //no error tag
+	}
+	if _, err := BuildCatalog(&cat); err != nil {
+		t.Fatalf("Valid tags should build: %v", err)
+	}
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			conn.Write([]byte("21.5\r"))
+		}
+	})
+	defer tc.Close()
+	if resp := tc.Control(cat.Temp); resp.Error != nil || string(resp.Bytes) != "21.5\r" {
+		t.Fatalf("A catalog command without an error tag should wait for its reply: %v", resp)
+	}
+}
+
+func TestTcp_MinResponseBytes(t *testing.T) {
+	fragmented := func(conn net.Conn) { //reply in two pieces
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte("DONT"))
+			time.Sleep(30 * time.Millisecond)
+			conn.Write([]byte("-ECHO"))
+		}
+	}
+	cmd := Command{
+		Name:          "fragmented",
+		Timeout:       200 * time.Millisecond,
+		Prototype:     "go",
+		CommandRegexp: regexp.MustCompile("go"),
+		Response:      regexp.MustCompile("DONT(-ECHO)?"),
+		Error:         regexp.MustCompile("a^"),
+	}
+
+	tc := pipeTcp(t, fragmented)
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "DONT" {
+		t.Fatalf("Without MinResponseBytes the partial reply should match: %v", resp)
+	}
+	tc.Close()
+
+	cmd.MinResponseBytes = len("DONT-ECHO")
+	tc = pipeTcp(t, fragmented)
+	defer tc.Close()
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "DONT-ECHO" {
+		t.Fatalf("MinResponseBytes should wait for the whole reply: %v", resp)
+	}
+}
+
+func TestTcp_Lookback(t *testing.T) {
+	chatty := func(conn net.Conn) { //stale OK and chatter, then the real reply
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte("OK status=idle temp=21.5 fan=on uptime=1234\n"))
+			time.Sleep(30 * time.Millisecond)
+			conn.Write([]byte("DONE\n"))
+		}
+	}
+	cmd := Command{
+		Name:          "chatty",
+		Timeout:       200 * time.Millisecond,
+		Prototype:     "go",
+		CommandRegexp: regexp.MustCompile("go"),
+		Response:      regexp.MustCompile("OK|DONE"),
+		Error:         regexp.MustCompile("a^"),
+	}
+
+	tc := pipeTcp(t, chatty)
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "OK" {
+		t.Fatalf("Without Lookback the stale OK should match: %v", resp)
+	}
+	tc.Close()
+
+	cmd.Lookback = len("DONE\n")
+	tc = pipeTcp(t, chatty)
+	defer tc.Close()
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "DONE" {
+		t.Fatalf("Lookback should only match the tail of the buffer: %v", resp)
+	}
+}
+
+func TestTcp_SetMaxQueue(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+	tc.SetMaxQueue(1)
+
+	inflight, waiting := make(chan Response), make(chan Response)
+	go func() { inflight <- tc.Control(pingBad) }()
+	time.Sleep(20 * time.Millisecond)
+	go func() { waiting <- tc.Control(pingOk) }()
+	time.Sleep(20 * time.Millisecond)
+
+	if n := tc.QueueLen(); n != 1 {
+		t.Fatalf("QueueLen should count the waiting command: %d", n)
+	}
+	if resp := tc.Control(pingOk); resp.Error != ErrQueueFull {
+		t.Fatalf("Saturated queue should return ErrQueueFull: %v", resp)
+	}
+	if resp := <-inflight; resp.Error != ErrTimeout {
+		t.Fatalf("In flight command should time out: %v", resp)
+	}
+	if resp := <-waiting; resp.Error != nil {
+		t.Fatalf("Queued command should run in turn: %v", resp)
+	}
+	if n := tc.QueueLen(); n != 0 {
+		t.Fatalf("Queue should have drained: %d", n)
+	}
+}
+
+func TestTcp_DialDeadline(t *testing.T) {
+	slow := func(delay time.Duration) func(string, time.Duration) (net.Conn, error) {
+		return func(string, time.Duration) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() { //answer every ping, but slowly
+				defer server.Close()
+				buf := make([]byte, 64)
+				for {
+					n, err := server.Read(buf)
+					if err != nil {
+						return
+					}
+					time.Sleep(delay)
+					server.Write(buf[:n])
+				}
+			}()
+			return client, nil
+		}
+	}
+
+	//each ping is well within pingOk.Timeout, but three of them are not within the Dial timeout
+	tc := &tcp{dialer: slow(60 * time.Millisecond)}
+	then := time.Now()
+	e := tc.Dial("pipe", 100*time.Millisecond, pingOk)
+	if !errors.Is(e, ErrPingFailed) || !errors.Is(e, ErrTimeout) {
+		t.Fatalf("Slow pings should fail Dial with a timeout: %v", e)
+	}
+	if took := time.Since(then); took > 150*time.Millisecond {
+		t.Fatalf("Dial should be bound by its timeout, took %v", took)
+	}
+
+	tc = &tcp{dialer: slow(10 * time.Millisecond)}
+	if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Pings within the timeout should succeed: %v", e)
+	}
+	tc.Close()
+}
+
+func TestTcp_SetOnConnect(t *testing.T) {
+	login := Command{
+		Name:          "login",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "LOGIN %s\r",
+		CommandRegexp: regexp.MustCompile("LOGIN [a-z]+\r"),
+		Response:      regexp.MustCompile("LOGIN [a-z]+\r"), //simulator echos
+		Error:         regexp.MustCompile("a^"),
+	}
+	tc := new(tcp)
+	var got Response
+	tc.SetOnConnect(func(a Arbiter) error {
+		got = a.Control(login, "admin")
+		return got.Error
+	})
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Dial with a working OnConnect should succeed: %v", e)
+	}
+	tc.Close()
+	if string(got.Bytes) != "LOGIN admin\r" {
+		t.Fatalf("OnConnect was not run against the connection: %v", got)
+	}
+
+	tc = new(tcp)
+	tc.SetOnConnect(func(a Arbiter) error { return ErrMatch })
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); !errors.Is(e, ErrSetupFailed) || !errors.Is(e, ErrMatch) {
+		t.Fatalf("Failing OnConnect should fail Dial with ErrSetupFailed: %v", e)
+	}
+	if resp := tc.Control(pingOk); resp.Error != ErrNotConnected {
+		t.Fatalf("Connection should be torn down after failed setup: %v", resp)
+	}
+}
+
+func TestTcp_TransportError(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		conn.Read(buf) //hang up on the first command
+	})
+	defer tc.Close()
+	resp := tc.Control(pingOk)
+	if !errors.Is(resp.Error, ErrTransport) || !errors.Is(resp.Error, io.EOF) {
+		t.Fatalf("Peer hanging up should be a transport error wrapping EOF: %v", resp.Error)
+	}
+	var te *TransportError
+	if !errors.As(resp.Error, &te) || te.Err != io.EOF {
+		t.Fatalf("Should be able to get at the TransportError: %v", resp.Error)
+	}
+	if errors.Is(ErrTimeout, ErrTransport) || errors.Is(ErrMatch, ErrTransport) {
+		t.Fatalf("Package errors are not transport errors")
+	}
+}
+
+func TestTcp_Tap(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	var w bytes.Buffer
+	tc.Tap(&w)
+	tc.Control(pingOk)
+	tc.Untap()
+	tc.Control(pingOk) //not tapped
+
+	tapRe := regexp.MustCompile(`(?m)^\S+ ([<>]) ([0-9]+)\n`)
+	var sent, rcvd []byte
+	rest := w.Bytes()
+	for len(rest) > 0 {
+		m := tapRe.FindSubmatchIndex(rest)
+		if m == nil || m[0] != 0 {
+			t.Fatalf("Tap output malformed at %q", rest)
+		}
+		n, _ := strconv.Atoi(string(rest[m[4]:m[5]]))
+		chunk := rest[m[1] : m[1]+n]
+		if rest[m[2]] == '>' {
+			sent = append(sent, chunk...)
+		} else {
+			rcvd = append(rcvd, chunk...)
+		}
+		rest = rest[m[1]+n+1:]
+	}
+	if string(sent) != "\r" || string(rcvd) != "\r" {
+		t.Fatalf("Tap should have one ping each way, got sent %q received %q", sent, rcvd)
+	}
+}
+
+//gatedWriter is a Tap writer that blocks until gate is closed
+type gatedWriter struct {
+	gate chan bool
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(b []byte) (int, error) {
+	<-w.gate
+	return w.buf.Write(b)
+}
+
+func TestTcp_TapSlowWriter(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	w := &gatedWriter{gate: make(chan bool)}
+	tc.Tap(w)
+	const pings = 150 //more chunks than the Tap buffers
+	for i := 0; i < pings; i++ {
+		if resp := tc.Control(pingOk); resp.Error != nil {
+			t.Fatalf("A stuck Tap writer should not hold up commands: ping %d %v", i, resp)
+		}
+	}
+	close(w.gate)
+	tc.Untap()
+
+	tapRe := regexp.MustCompile(`(?m)^\S+ ([<>!]) ([0-9]+)\n`)
+	chunks, lost := 0, 0
+	rest := w.buf.Bytes()
+	for len(rest) > 0 {
+		m := tapRe.FindSubmatchIndex(rest)
+		if m == nil || m[0] != 0 {
+			t.Fatalf("Tap output malformed at %q", rest)
+		}
+		n, _ := strconv.Atoi(string(rest[m[4]:m[5]]))
+		if rest[m[2]] == '!' {
+			dropped, _ := strconv.Atoi(string(rest[m[1] : m[1]+n]))
+			lost += dropped
+		} else {
+			chunks++
+		}
+		rest = rest[m[1]+n+1:]
+	}
+	if lost == 0 || chunks+lost != 2*pings {
+		t.Fatalf("Every chunk should be tapped or counted as dropped: %d tapped, %d dropped, of %d", chunks, lost, 2*pings)
+	}
+}
+
+func TestTcp_WaitIdle(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.WaitIdle(10 * time.Millisecond); e != nil {
+		t.Fatalf("Unconnected arbiter is idle: %v", e)
+	}
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	done := make(chan Response, 1)
+	go func() { done <- tc.Control(pingBad) }() //150ms to time out
+	time.Sleep(20 * time.Millisecond)
+	if e := tc.WaitIdle(20 * time.Millisecond); e != ErrTimeout {
+		t.Fatalf("WaitIdle should time out while a command is in flight: %v", e)
+	}
+	if e := tc.WaitIdle(time.Second); e != nil {
+		t.Fatalf("WaitIdle should return once the command finishes: %v", e)
+	}
+	select {
+	case <-done:
+	default:
+		t.Fatalf("WaitIdle returned before the command finished")
+	}
+
+	before := runtime.NumGoroutine()
+	tc.ctl.Lock() //a command that never finishes
+	for i := 0; i < 10; i++ {
+		if e := tc.WaitIdle(time.Millisecond); e != ErrTimeout {
+			t.Fatalf("WaitIdle should time out while a command is in flight: %v", e)
+		}
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("Timed out WaitIdles should leave nothing behind: %d goroutines, was %d", n, before)
+	}
+	tc.ctl.Unlock()
+}
+
+func TestTcp_WaitIdleFakeClock(t *testing.T) {
+	fc := &fakeClock{now: time.Unix(0, 0)}
+	tc := &tcp{clock: fc}
+	tc.ctl.Lock() //a command in flight
+	idle := make(chan error, 1)
+	go func() { idle <- tc.WaitIdle(time.Hour) }()
+	select {
+	case e := <-idle:
+		t.Fatalf("WaitIdle should not time out until the clock says so: %v", e)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fc.Advance(time.Hour)
+	select {
+	case e := <-idle:
+		if e != ErrTimeout {
+			t.Fatalf("WaitIdle should time out on the clock: %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Advancing the clock past timeout should end WaitIdle")
+	}
+
+	go func() { idle <- tc.WaitIdle(time.Hour) }()
+	time.Sleep(20 * time.Millisecond)
+	tc.unlock() //the command finishes
+	select {
+	case e := <-idle:
+		if e != nil {
+			t.Fatalf("WaitIdle should return once the command finishes: %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Finishing the command should wake WaitIdle without time passing")
+	}
+}
+
+func TestTcp_TrailerTimeout(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte("12.5\r\n")) //never sends the prompt
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "temp",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "TEMP?\r",
+		CommandRegexp: regexp.MustCompile("TEMP\\?\r"),
+		Response:      regexp.MustCompile(`[0-9.]+\r\n`),
+		Trailer:       regexp.MustCompile(`^> $`),
+	}
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "12.5\r\n" {
+		t.Fatalf("A missing Trailer should not lose the reply: %q %v", resp.Bytes, resp.Error)
+	}
+	cmd.Response = regexp.MustCompile(`OK`)
+	if resp := tc.Control(cmd); resp.Error != ErrTimeout {
+		t.Fatalf("No reply at all should still time out: %q %v", resp.Bytes, resp.Error)
+	}
+}
+
+func TestTcp_DialPingError(t *testing.T) {
+	pingErr := Command{
+		Name:          "ping err",
+		Timeout:       time.Second,
+		Prototype:     "ERR\r",
+		CommandRegexp: regexp.MustCompile("ERR\r"),
+		Response:      regexp.MustCompile("OK\r"),
+		Error:         regexp.MustCompile("ERR\r"), //the simulator echos, so the device always says no
+	}
+	tc := new(tcp)
+	then := time.Now()
+	e := tc.Dial(dial, 3*time.Second, pingErr)
+	if !errors.Is(e, ErrPingFailed) || !errors.Is(e, ErrMatch) {
+		t.Fatalf("An error reply to the ping should fail Dial with ErrMatch: %v", e)
+	}
+	if took := time.Since(then); took > pingErr.Timeout/2 {
+		t.Fatalf("An error reply to the ping should fail fast, took %v", took)
+	}
+	if tc.alive.Load() {
+		t.Fatalf("Failed Dial should leave the arbiter closed")
+	}
+}
+
+func TestTcp_ControlContext(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	if resp := tc.ControlContext(context.Background(), pingOk); resp.Error != nil {
+		t.Fatalf("ControlContext should behave like Control: %v", resp)
+	}
+
+	//pingBad times out after 150ms, so the shorter context deadline wins
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	then := time.Now()
+	if resp := tc.ControlContext(ctx, pingBad); resp.Error != context.DeadlineExceeded {
+		t.Fatalf("Context deadline should win over a longer Timeout: %v", resp)
+	}
+	if took := time.Since(then); took > 100*time.Millisecond {
+		t.Fatalf("Context deadline should cut the command short, took %v", took)
+	}
+
+	//and the shorter Timeout wins over a longer context deadline
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if resp := tc.ControlContext(ctx, pingBad); resp.Error != ErrTimeout {
+		t.Fatalf("Timeout should win over a longer context deadline: %v", resp)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if resp := tc.ControlContext(ctx, pingBad); resp.Error != context.Canceled {
+		t.Fatalf("Cancelling the context should end the command: %v", resp)
+	}
+	if resp := tc.ControlContext(ctx, pingOk); resp.Error != context.Canceled {
+		t.Fatalf("A done context should not send anything: %v", resp)
+	}
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Arbiter should still work after a cancelled command: %v", resp)
+	}
+}
+
+func TestTcp_ControlContextQueued(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	slow := make(chan Response, 1)
+	go func() { slow <- tc.Control(pingBad) }() //times out after 150ms
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	then := time.Now()
+	if resp := tc.ControlContext(ctx, pingOk); resp.Error != context.DeadlineExceeded {
+		t.Fatalf("Context deadline should end the wait behind the command in flight: %v", resp)
+	}
+	if took := time.Since(then); took > 100*time.Millisecond {
+		t.Fatalf("Should give up waiting once the context is done, took %v", took)
+	}
+	if n := tc.QueueLen(); n != 0 {
+		t.Fatalf("Giving up should leave the queue: %d waiting", n)
+	}
+	if r := <-slow; r.Error != ErrTimeout {
+		t.Fatalf("Command in flight should be unaffected: %v", r)
+	}
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Arbiter should still work after giving up a turn: %v", resp)
+	}
+}
+
+func TestSetMaxConcurrentDials(t *testing.T) {
+	SetMaxConcurrentDials(1)
+	defer SetMaxConcurrentDials(0)
+
+	release, err := acquireDial(realClock{}, time.Now().Add(time.Second)) //hold the only slot
+	if err != nil {
+		t.Fatalf("Should get the only dial slot: %v", err)
+	}
+	tc := new(tcp)
+	then := time.Now()
+	e := tc.Dial(dial, 50*time.Millisecond, pingOk)
+	if !errors.Is(e, ErrConnectFailed) || !errors.Is(e, ErrTimeout) {
+		t.Fatalf("Dial should time out waiting for a slot: %v", e)
+	}
+	if took := time.Since(then); took > 100*time.Millisecond {
+		t.Fatalf("Waiting for a slot should be bound by the Dial timeout, took %v", took)
+	}
+
+	time.AfterFunc(20*time.Millisecond, release)
+	if e := tc.Dial(dial, time.Second, pingOk); e != nil {
+		t.Fatalf("Dial should proceed once the slot frees: %v", e)
+	}
+	tc.Close()
+	if e := tc.Dial(dial, time.Second, pingOk); e != nil {
+		t.Fatalf("Dial should give its slot back: %v", e)
+	}
+	tc.Close()
+}
+
+func TestTcp_EchoConfirm(t *testing.T) {
+	set := Command{
+		Name:          "set",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "SET %d\r",
+		CommandRegexp: regexp.MustCompile(`^SET \d+\r$`),
+		EchoConfirm:   true,
+	}
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	if resp := tc.Control(set, 42); resp.Error != nil || string(resp.Bytes) != "SET 42\r" {
+		t.Fatalf("The echo should confirm the command: %v", resp)
+	}
+	tc.Close()
+
+	garbled := func(conn net.Conn) { //echos back a different value
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(bytes.Replace(buf[:n], []byte("42"), []byte("24"), 1))
+		}
+	}
+	tc = pipeTcp(t, garbled)
+	defer tc.Close()
+	if resp := tc.Control(set, 42); resp.Error != ErrTimeout {
+		t.Fatalf("An echo that differs from what was sent should not confirm: %v", resp)
+	}
+
+	set.ETX = '\r'
+	if resp := tc.Control(set, 42); !errors.Is(resp.Error, ErrEchoFramed) {
+		t.Fatalf("EchoConfirm with framed replies should be refused: %v", resp)
+	}
+	if _, formed, err := set.match([]byte("SET 42\r")); !formed || err != ErrEchoFramed {
+		t.Fatalf("EchoConfirm with framed replies should never match: %v %v", formed, err)
+	}
+}
+
+func TestTcp_SetMaxLifetime(t *testing.T) {
+	tc := new(tcp)
+	tc.SetMaxLifetime(100 * time.Millisecond)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Connection should work within its lifetime: %v", resp)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if resp := tc.Control(pingOk); resp.Error != ErrNotConnected {
+		t.Fatalf("Connection should be closed once its lifetime is up: %v", resp)
+	}
+
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Should be able to redial after the lifetime is up: %v", e)
+	}
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Redialed connection should get a fresh lifetime: %v", resp)
+	}
+}
+
+func TestTcp_CloseConcurrent(t *testing.T) {
+	tc := new(tcp)
+	tc.SetMaxLifetime(20 * time.Millisecond)
+	runs := Runners()
+	for i := 0; i < 5; i++ {
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial #%d failed: %v", i, e)
+		}
+		time.Sleep(19 * time.Millisecond) //close about when the lifetime is up
+		var wg sync.WaitGroup
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tc.Close()
+			}()
+		}
+		closed := make(chan bool)
+		go func() {
+			wg.Wait()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatalf("Concurrent Closes should all return")
+		}
+		if tc.alive.Load() || Runners() != runs {
+			t.Fatalf("Closed connection should have no runner left")
+		}
+	}
+}
+
+func TestTcp_Done(t *testing.T) {
+	isDone := func(tc *tcp, within time.Duration) bool {
+		select {
+		case <-tc.Done():
+			return true
+		default:
+		}
+		select {
+		case <-tc.Done():
+			return true
+		case <-time.After(within):
+			return false
+		}
+	}
+	tc := new(tcp)
+	if !isDone(tc, 0) {
+		t.Fatalf("Done should be closed before any Dial")
+	}
+	tc.SetMaxLifetime(50 * time.Millisecond)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	if isDone(tc, 10*time.Millisecond) {
+		t.Fatalf("Done should be open while connected")
+	}
+	if !isDone(tc, 200*time.Millisecond) {
+		t.Fatalf("Done should close when the lifetime is up")
+	}
+
+	tc.SetMaxLifetime(0)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil || isDone(tc, 0) {
+		t.Fatalf("Redialing should give a fresh, open Done: %v", e)
+	}
+	done := tc.Done()
+	tc.Close()
+	if !isDone(tc, 0) || done != tc.Done() {
+		t.Fatalf("Done should close on Close")
+	}
+
+	pipe := pipeTcp(t, func(conn net.Conn) {}) //hangs up straight after the pings
+	defer pipe.Close()
+	if !isDone(pipe, 200*time.Millisecond) {
+		t.Fatalf("Done should close on a transport error")
+	}
+}
+
+//fakeClock only moves when Advanced, which also fires all of its tickers and any timers that are due
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []chan time.Time
+	timers  []*fakeTimer
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) NewTicker(time.Duration) ticker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	f.tickers = append(f.tickers, c)
+	return fakeTicker(c)
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for _, c := range f.tickers {
+		select {
+		case c <- f.now:
+		default:
+		}
+	}
+	for _, tm := range f.timers {
+		if !f.now.Before(tm.at) && tm.stopped.CompareAndSwap(false, true) {
+			go tm.f()
+		}
+	}
+}
+
+func (f *fakeClock) AfterFunc(d time.Duration, fn func()) timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	tm := &fakeTimer{at: f.now.Add(d), f: fn}
+	f.timers = append(f.timers, tm)
+	return tm
+}
+
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped atomic.Bool //fired or stopped
+}
+
+func (f *fakeTimer) Stop() bool { return f.stopped.CompareAndSwap(false, true) }
+
+type fakeTicker chan time.Time
+
+func (f fakeTicker) C() <-chan time.Time { return f }
+func (f fakeTicker) Stop()               {}
+
+func TestTcp_fakeClock(t *testing.T) {
+	fc := &fakeClock{now: time.Unix(0, 0)}
+	tc := &tcp{clock: fc}
+	done := make(chan bool)
+	defer close(done)
+	go func() { //poll the socket, without time passing
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				fc.Advance(0)
+			}
+		}
+	}()
+	if e := tc.Dial(dial, time.Second, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup: %v", e)
+	}
+	defer tc.Close()
+
+	resp := make(chan Response, 1)
+	go func() { resp <- tc.Control(pingBad.WithTimeout(time.Hour)) }()
+	select {
+	case r := <-resp:
+		t.Fatalf("Command should not time out until the clock says so: %v", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fc.Advance(time.Hour + time.Nanosecond)
+	select {
+	case r := <-resp:
+		if r.Error != ErrTimeout || r.Duration != time.Hour+time.Nanosecond {
+			t.Fatalf("Command should time out on the clock: %v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Advancing the clock past Timeout should time the command out")
+	}
+}
+
+func TestTcp_fakeClockDial(t *testing.T) {
+	fc := &fakeClock{now: time.Unix(0, 0)}
+	tc := &tcp{clock: fc}
+	ticking := make(chan bool)
+	go func() { //poll the socket while dialing, without time passing
+		for {
+			select {
+			case <-ticking:
+				return
+			case <-time.After(time.Millisecond):
+				fc.Advance(0)
+			}
+		}
+	}()
+	tc.SetMaxLifetime(time.Hour)
+	if e := tc.Dial(dial, time.Second, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup: %v", e)
+	}
+	defer tc.Close()
+	close(ticking)
+	select {
+	case <-tc.Done():
+		t.Fatalf("The lifetime should not run out until the clock says so")
+	case <-time.After(20 * time.Millisecond):
+	}
+	fc.Advance(time.Hour)
+	select {
+	case <-tc.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Advancing the clock past the lifetime should close the connection")
+	}
+
+	slow := &tcp{clock: fc, dialer: func(string, time.Duration) (net.Conn, error) {
+		fc.Advance(2 * time.Second) //connecting used up all of the time
+		client, server := net.Pipe()
+		go HandleRequest(server)
+		return client, nil
+	}}
+	if e := slow.Dial("pipe", time.Second, pingOk); !errors.Is(e, ErrPingFailed) || !errors.Is(e, ErrTimeout) {
+		t.Fatalf("Dial should run out of time by the clock: %v", e)
+	}
+}
+
+func TestTcp_HalfClosedPeer(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Unable to start listener: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		for i := 0; i < 3; i++ { //answer the Dial pings
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			conn.Write(buf[:n])
+		}
+		conn.(*net.TCPConn).CloseWrite() //then stop talking, but keep taking writes
+		io.Copy(io.Discard, conn)
+	}()
+
+	tc := new(tcp)
+	if e := tc.Dial(l.Addr().String(), 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup: %v", e)
+	}
+	defer tc.Close()
+	if resp := tc.Control(pingOk); !errors.Is(resp.Error, ErrNotConnected) || !errors.Is(resp.Error, io.EOF) {
+		t.Fatalf("A half closed peer should report ErrNotConnected rather than ErrTimeout: %v", resp)
+	}
+}
+
+func TestTcp_Cooldown(t *testing.T) {
+	busy := func(n int) func(net.Conn) { //busy for the first n commands
+		return func(conn net.Conn) {
+			buf := make([]byte, 64)
+			for i := 0; ; i++ {
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				if i < n {
+					conn.Write([]byte("BUSY 10ms\r"))
+				} else {
+					conn.Write([]byte("OK\r"))
+				}
+			}
+		}
+	}
+	cmd := Command{
+		Name:             "start",
+		Timeout:          100 * time.Millisecond,
+		Prototype:        "START\r",
+		CommandRegexp:    regexp.MustCompile("START\r"),
+		Response:         regexp.MustCompile("OK\r"),
+		CooldownResponse: regexp.MustCompile(`BUSY \d+ms\r`),
+		Cooldown:         20 * time.Millisecond,
+		CooldownRetries:  2,
+	}
+
+	tc := pipeTcp(t, busy(2))
+	then := time.Now()
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "OK\r" {
+		t.Fatalf("Command should be retried through the cooldowns: %v", resp)
+	}
+	if took := time.Since(then); took < 2*cmd.Cooldown {
+		t.Fatalf("Should wait Cooldown between retries, took %v", took)
+	}
+	tc.Close()
+
+	tc = pipeTcp(t, busy(3))
+	defer tc.Close()
+	if resp := tc.Control(cmd); resp.Error != ErrCooldown {
+		t.Fatalf("Should give up with ErrCooldown once out of retries: %v", resp)
+	}
+}
+
+func TestTcp_TryControlCooldown(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //busy for the first command
+		buf := make([]byte, 64)
+		for i := 0; ; i++ {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			if i < 1 {
+				conn.Write([]byte("BUSY 10ms\r"))
+			} else {
+				conn.Write([]byte("OK\r"))
+			}
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:             "start",
+		Timeout:          100 * time.Millisecond,
+		Prototype:        "START\r",
+		CommandRegexp:    regexp.MustCompile("START\r"),
+		Response:         regexp.MustCompile("OK\r"),
+		CooldownResponse: regexp.MustCompile(`BUSY \d+ms\r`),
+		Cooldown:         20 * time.Millisecond,
+		CooldownRetries:  1,
+	}
+	then := time.Now()
+	if resp, ok := tc.TryControl(cmd); !ok || resp.Error != nil || string(resp.Bytes) != "OK\r" {
+		t.Fatalf("TryControl should retry through the cooldown like Control: %v %v", resp, ok)
+	}
+	if took := time.Since(then); took < cmd.Cooldown {
+		t.Fatalf("Should wait Cooldown before retrying, took %v", took)
+	}
+}
+
+func TestTcp_ReadCount(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //reply in three pieces
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			for _, piece := range []string{"12", "3.", "45\r"} {
+				conn.Write([]byte(piece))
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "read",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "READ\r",
+		CommandRegexp: regexp.MustCompile("READ\r"),
+		Response:      regexp.MustCompile(`[0-9.]+\r`),
+	}
+	for i := 0; i < 2; i++ { //counts start over with each command
+		if resp := tc.Control(cmd); resp.Error != nil || resp.ReadCount != 3 || resp.TotalRead != 7 {
+			t.Fatalf("Should count 3 reads of 7 bytes: %d %d %v", resp.ReadCount, resp.TotalRead, resp)
+		}
+	}
+}
+
+func TestTcp_Continuation(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //pages output, waiting on a space after each --More--
+		buf := make([]byte, 64)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		for _, page := range []string{"line 1\r\n--More--", "line 2\r\n--More--"} {
+			conn.Write([]byte(page))
+			if n, err := conn.Read(buf); err != nil || string(buf[:n]) != " " {
+				return
+			}
+		}
+		conn.Write([]byte("line 3\r\n> "))
+		io.Copy(io.Discard, conn)
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:                "show",
+		Timeout:             200 * time.Millisecond,
+		Prototype:           "show log\r",
+		CommandRegexp:       regexp.MustCompile("show log\r"),
+		Response:            regexp.MustCompile("> $"),
+		ReturnAll:           true,
+		ContinuationPattern: regexp.MustCompile("--More--"),
+		ContinuationInput:   " ",
+	}
+	want := "line 1\r\n--More--line 2\r\n--More--line 3\r\n> "
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != want {
+		t.Fatalf("Should page through to the prompt: %v", resp)
+	}
+}
+
+func TestTcp_Streaming(t *testing.T) {
+	line := strings.Repeat("x", 99) + "\n"
+	tc := pipeTcp(t, func(conn net.Conn) { //a long log, with the terminator split across writes
+		buf := make([]byte, 64)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		for i := 0; i < 100; i++ {
+			conn.Write([]byte(strings.Repeat(line, 20)))
+		}
+		conn.Write([]byte("\r\nEN"))
+		time.Sleep(10 * time.Millisecond)
+		conn.Write([]byte("D\r\n"))
+		io.Copy(io.Discard, conn)
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "log",
+		Timeout:       2 * time.Second,
+		Prototype:     "dump log\r",
+		CommandRegexp: regexp.MustCompile("dump log\r"),
+		Response:      regexp.MustCompile("\r\nEND\r\n"),
+		Error:         regexp.MustCompile("ERR [0-9]{3}"),
+		ReturnAll:     true,
+		Streaming:     true,
+	}
+	want := strings.Repeat(line, 2000) + "\r\nEND\r\n"
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != want {
+		t.Fatalf("Streaming should still find the terminator and return the whole reply: %v (%d bytes)", resp.Error, len(resp.Bytes))
+	}
+}
+
+func TestTcp_ControlID(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	defer tc.Close()
+	if resp := tc.ControlID("req-1", pingOk); resp.Error != nil || resp.ID != "req-1" {
+		t.Fatalf("ControlID should tag the Response: %v %q", resp, resp.ID)
+	}
+	if resp := tc.ControlID("req-2", pingOk, "extra"); resp.Error == nil || resp.ID != "req-2" {
+		t.Fatalf("Failed commands should be tagged too: %v %q", resp, resp.ID)
+	}
+	if resp := tc.Control(pingOk); resp.ID != "" {
+		t.Fatalf("Plain Control should not have an ID: %q", resp.ID)
+	}
+}
+
+func TestTcp_Codec(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //answers each framed request with the payload reversed, framed
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			req, _, ok := LengthPrefix{Size: 1}.Decode(buf[:n])
+			if !ok {
+				return
+			}
+			rev := make([]byte, len(req))
+			for i := range req {
+				rev[len(req)-1-i] = req[i]
+			}
+			conn.Write(LengthPrefix{Size: 1}.Encode(rev))
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "rev",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "abc",
+		CommandRegexp: regexp.MustCompile("abc"),
+		Codec:         LengthPrefix{Size: 1},
+	}
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "cba" {
+		t.Fatalf("Codec should frame the request and the reply: %v", resp)
+	}
+}
+
+func TestTcp_CloseErrors(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	if e := tc.Close(); e != nil {
+		t.Fatalf("A healthy connection should Close cleanly: %v", e)
+	}
+
+	tc = pipeTcp(t, func(conn net.Conn) {}) //hangs up right after the pings
+	for i := 0; i < 2; i++ {
+		if resp := tc.Control(pingOk); !errors.Is(resp.Error, ErrTransport) {
+			t.Fatalf("Hung up connection should fail: %v", resp)
+		}
+	}
+	e := tc.Close()
+	if !errors.Is(e, ErrTransport) {
+		t.Fatalf("Close should return the errors the connection suffered: %v", e)
+	}
+	seen := map[string]bool{}
+	for _, err := range e.(interface{ Unwrap() []error }).Unwrap() {
+		if seen[err.Error()] {
+			t.Fatalf("Repeats of the same error should only be reported once: %v", e)
+		}
+		seen[err.Error()] = true
+	}
+}
+
+func TestTcp_SilenceIsSuccess(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	silent := pingBad //the simulator stays quiet on DONT-ECHO
+	silent.SilenceIsSuccess = true
+	if resp := tc.Control(silent); resp.Error != nil || len(resp.Bytes) != 0 || resp.Duration < silent.Timeout {
+		t.Fatalf("Silence for the whole Timeout should be success: %v", resp)
+	}
+
+	echoed := Command{ //the simulator echos everything else
+		Name:             "echoed",
+		Timeout:          50 * time.Millisecond,
+		Prototype:        "ERR %s\r",
+		CommandRegexp:    regexp.MustCompile(`ERR \w+\r`),
+		Response:         regexp.MustCompile("a^"),
+		Error:            regexp.MustCompile("ERR bad"),
+		SilenceIsSuccess: true,
+	}
+	if resp := tc.Control(echoed, "bad"); resp.Error != ErrMatch {
+		t.Fatalf("Error replies should still fail: %v", resp)
+	}
+	if resp := tc.Control(echoed, "other"); resp.Error != ErrTimeout {
+		t.Fatalf("Unmatched replies are not silence: %v", resp)
+	}
+}
+
+func TestTcp_NegativeConfirm(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	watch := Command{ //the simulator echos, so the arg decides if a fault shows up
+		Name:            "watch",
+		Timeout:         50 * time.Millisecond,
+		Prototype:       "START %s\r",
+		CommandRegexp:   regexp.MustCompile(`START \w+\r`),
+		Response:        regexp.MustCompile("START"),
+		Error:           regexp.MustCompile("FAULT"),
+		NegativeConfirm: true,
+	}
+	resp := tc.Control(watch, "ok")
+	if resp.Error != nil || string(resp.Bytes) != "START ok\r" || resp.Duration < watch.Timeout {
+		t.Fatalf("No fault for the whole Timeout should be success, ignoring Response: %v", resp)
+	}
+	if resp := tc.Control(watch, "FAULT"); resp.Error != ErrMatch || resp.Duration >= watch.Timeout {
+		t.Fatalf("A fault should fail straight away: %v", resp)
+	}
+}
+
+func TestTcp_SetCircuitBreaker(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+	fast := pingBad.WithTimeout(10 * time.Millisecond)
+	tc.SetCircuitBreaker(2, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if resp := tc.Control(fast); resp.Error != ErrTimeout {
+			t.Fatalf("Command should fail normally until the circuit opens: %v", resp)
+		}
+	}
+	then := time.Now()
+	if resp := tc.Control(pingOk); resp.Error != ErrCircuitOpen || time.Since(then) > 5*time.Millisecond {
+		t.Fatalf("Open circuit should fail fast: %v", resp)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if resp := tc.Control(fast); resp.Error != ErrTimeout {
+		t.Fatalf("Trial command should go through after the cooldown: %v", resp)
+	}
+	if resp := tc.Control(pingOk); resp.Error != ErrCircuitOpen {
+		t.Fatalf("Failed trial should reopen the circuit: %v", resp)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Trial command should succeed: %v", resp)
+	}
+	if resp := tc.Control(fast); resp.Error != ErrTimeout {
+		t.Fatalf("Successful trial should close the circuit: %v", resp)
+	}
+}
+
+func TestTcp_ControlDeadline(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	if resp := tc.ControlDeadline(pingOk, time.Now().Add(100*time.Millisecond)); resp.Error != nil {
+		t.Fatalf("ControlDeadline should behave like Control: %v", resp)
+	}
+	then := time.Now()
+	if resp := tc.ControlDeadline(pingBad, then.Add(30*time.Millisecond)); resp.Error != ErrTimeout {
+		t.Fatalf("Deadline should time the command out: %v", resp)
+	}
+	if took := time.Since(then); took > 100*time.Millisecond {
+		t.Fatalf("Deadline should take the place of a longer Timeout, took %v", took)
+	}
+	then = time.Now()
+	if resp := tc.ControlDeadline(pingBad.WithTimeout(time.Millisecond), then.Add(50*time.Millisecond)); resp.Error != ErrTimeout {
+		t.Fatalf("Deadline should time the command out: %v", resp)
+	}
+	if took := time.Since(then); took < 50*time.Millisecond {
+		t.Fatalf("Deadline should take the place of a shorter Timeout, took %v", took)
+	}
+}
+
+func TestTcp_SetStateObserver(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+
+	var mu sync.Mutex
+	var seen []string
+	tc.SetStateObserver(func(from, to int) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, fmt.Sprintf("%d>%d", from, to))
+	})
+	tc.Control(pingOk)
+	var got string
+	for then := time.Now(); time.Since(then) < 100*time.Millisecond; time.Sleep(time.Millisecond) { //runner goes idle just after handing back the Response
+		mu.Lock()
+		got = strings.Join(seen, " ")
+		mu.Unlock()
+		if len(strings.Fields(got)) >= 3 {
+			break
+		}
+	}
+	want := fmt.Sprintf("%d>%d %d>%d %d>%d", StateIdle, StateWaitingOnReply, StateWaitingOnReply, StateResponseFormed, StateResponseFormed, StateIdle)
+	if got != want {
+		t.Fatalf("Observer should see a full cycle: got %q want %q", got, want)
+	}
+
+	snaps := make(chan Snapshot, 8)
+	tc.SetStateObserver(func(from, to int) {
+		select {
+		case snaps <- tc.Snapshot():
+		default:
+		}
+	})
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("An observer calling Snapshot should not deadlock the runner: %v", resp)
+	}
+	if s := <-snaps; s.State != StateWaitingOnReply || !s.Connected {
+		t.Errorf("Snapshot from the observer should see the state entered: %+v", s)
+	}
+
+	tc.SetStateObserver(nil)
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Fatalf("Removing the observer should not upset anything: %v", resp)
+	}
+}
+
+func TestTcp_LastError(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { time.Sleep(20 * time.Millisecond) }) //hangs up shortly after the pings
+	defer tc.Close()
+	if e := tc.LastError(); e != nil {
+		t.Fatalf("Healthy connection should have no error: %v", e)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if e := tc.LastError(); !errors.Is(e, io.EOF) || !errors.Is(e, ErrTransport) {
+		t.Fatalf("Hang up should be reported without issuing a command: %v", e)
+	}
+
+	tc2 := new(tcp)
+	if e := tc2.Dial("localhost:1", 100*time.Millisecond, pingOk); e == nil || !errors.Is(tc2.LastError(), ErrTransport) {
+		t.Fatalf("Failure to connect should be reported: %v %v", e, tc2.LastError())
+	}
+}
+
+func TestTcp_SetWireCodec(t *testing.T) {
+	received := make(chan string, 1)
+	tc := pipeTcp(t, func(conn net.Conn) { //speaks base64, a line per message
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			reply := base64.StdEncoding.EncodeToString([]byte("OK\r")) + "\n"
+			conn.Write([]byte(reply[:2])) //split mid quantum
+			time.Sleep(5 * time.Millisecond)
+			conn.Write([]byte(reply[2:]))
+		}
+	})
+	defer tc.Close()
+	var pending []byte
+	tc.SetWireCodec(func(b []byte) []byte {
+		return []byte(base64.StdEncoding.EncodeToString(b) + "\n")
+	}, func(b []byte) []byte {
+		pending = append(pending, b...)
+		var out []byte
+		for i := bytes.IndexByte(pending, '\n'); i >= 0; i = bytes.IndexByte(pending, '\n') {
+			dec, _ := base64.StdEncoding.DecodeString(string(pending[:i]))
+			out, pending = append(out, dec...), pending[i+1:]
+		}
+		return out
+	})
+	cmd := Command{
+		Name:          "status",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "STATUS\r",
+		CommandRegexp: regexp.MustCompile("^STATUS\r$"),
+		Response:      regexp.MustCompile("^OK\r$"),
+	}
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "OK\r" {
+		t.Fatalf("Command should work in decoded bytes: %v", resp)
+	}
+	if got := <-received; got != "U1RBVFVTDQ==\n" {
+		t.Fatalf("Request should go out encoded: %q", got)
+	}
+	tc.SetWireCodec(nil, nil)
+	if resp := tc.Control(cmd); resp.Error != ErrTimeout || <-received != "STATUS\r" {
+		t.Fatalf("Removing the codec should send raw bytes again: %v", resp)
+	}
+}
+
+func TestTcp_CacheTTL(t *testing.T) {
+	var asked atomic.Int64
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			asked.Add(1)
+			conn.Write(append([]byte("SN"), buf[:n]...))
+		}
+	})
+	defer tc.Close()
+	serial := Command{
+		Name:          "serial",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "%d\r",
+		CommandRegexp: regexp.MustCompile(`^\d+\r$`),
+		Response:      regexp.MustCompile(`SN\d+\r`),
+		CacheTTL:      50 * time.Millisecond,
+	}
+	first := tc.Control(serial, 1)
+	first.Bytes[0] = 'X'
+	if resp := tc.Control(serial, 1); resp.Error != nil || string(resp.Bytes) != "SN1\r" || asked.Load() != 1 {
+		t.Fatalf("Second call within the TTL should be cached, unaffected by callers: %v (asked %d)", resp, asked.Load())
+	}
+	if resp := tc.Control(serial, 2); string(resp.Bytes) != "SN2\r" || asked.Load() != 2 {
+		t.Fatalf("Different args should not share a cache entry: %v (asked %d)", resp, asked.Load())
+	}
+	if resp, ok := tc.TryControl(serial, 1); !ok || string(resp.Bytes) != "SN1\r" || asked.Load() != 2 {
+		t.Fatalf("TryControl should be answered from the cache too: %v %v (asked %d)", resp, ok, asked.Load())
+	}
+	if resp, ok := tc.TryControl(serial, 3); !ok || string(resp.Bytes) != "SN3\r" || asked.Load() != 3 {
+		t.Fatalf("TryControl should ask the device when nothing is cached: %v %v (asked %d)", resp, ok, asked.Load())
+	}
+	if resp := tc.Control(serial, 3); string(resp.Bytes) != "SN3\r" || asked.Load() != 3 {
+		t.Fatalf("What TryControl received should be cached for Control: %v (asked %d)", resp, asked.Load())
+	}
+	tc.CacheClear()
+	if tc.Control(serial, 1); asked.Load() != 4 {
+		t.Fatalf("CacheClear should drop cached Responses (asked %d)", asked.Load())
+	}
+	time.Sleep(serial.CacheTTL)
+	if tc.Control(serial, 1); asked.Load() != 5 {
+		t.Fatalf("Cached Responses should expire after the TTL (asked %d)", asked.Load())
+	}
+	serial.CacheTTL = 0
+	if tc.Control(serial, 1); asked.Load() != 6 {
+		t.Fatalf("Commands without a CacheTTL should not be cached (asked %d)", asked.Load())
+	}
+}
+
+func TestTcp_ControlProgress(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		for _, line := range []string{"10%\r\n", "50%\r\n", "DONE\r\n"} {
+			conn.Write([]byte(line))
+			time.Sleep(10 * time.Millisecond)
+		}
+		io.Copy(io.Discard, conn)
+	})
+	defer tc.Close()
+	flash := Command{
+		Name:          "flash",
+		Timeout:       time.Second,
+		Prototype:     "FLASH\r",
+		CommandRegexp: regexp.MustCompile("FLASH\r"),
+		Response:      regexp.MustCompile("DONE\r\n"),
+	}
+	var chunks []string
+	resp := tc.ControlProgress(flash, func(b []byte) { chunks = append(chunks, string(b)) })
+	if resp.Error != nil || string(resp.Bytes) != "DONE\r\n" {
+		t.Fatalf("Final Response should be as from Control: %v", resp)
+	}
+	if len(chunks) < 2 || strings.Join(chunks, "") != "10%\r\n50%\r\nDONE\r\n" {
+		t.Fatalf("Every piece of the reply should be handed over as it arrives: %q", chunks)
+	}
+}
+
+func TestTcp_CloseCause(t *testing.T) {
+	tests := []struct {
+		cmd       Command
+		want, not error
+	}{
+		{closeNice, ErrConnClosed, ErrConnReset},
+		{closeEvil, ErrConnReset, ErrConnClosed},
+	}
+	for _, test := range tests {
+		tc := new(tcp)
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Need initial connection to be setup, and couldnt setup")
+		}
+		cmd := test.cmd //wait on the close, not the "ok" ahead of it
+		cmd.Response, cmd.Timeout = regexp.MustCompile("a^"), time.Second
+		resp := tc.Control(cmd)
+		if !errors.Is(resp.Error, test.want) || errors.Is(resp.Error, test.not) || !errors.Is(resp.Error, ErrTransport) {
+			t.Errorf("%s should fail with %v: %v", cmd.Name, test.want, resp.Error)
+		}
+		tc.Close()
+	}
+}
+
+func TestTcp_ControlAsync(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { io.Copy(conn, conn) })
+	defer tc.Close()
+	echo := Command{
+		Name:          "echo",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "%d\r",
+		CommandRegexp: regexp.MustCompile(`^\d+\r$`),
+		Response:      regexp.MustCompile(`\d+\r`),
+	}
+	results := make(chan string, 20)
+	then := time.Now()
+	for i := 0; i < 20; i++ {
+		tc.ControlAsync(echo, func(r Response) { results <- string(r.Bytes) }, i)
+	}
+	if time.Since(then) > 5*time.Millisecond {
+		t.Fatalf("ControlAsync should not wait on the commands")
+	}
+	if resp := tc.Control(echo, 99); string(resp.Bytes) != "99\r" {
+		t.Fatalf("Control should take its turn alongside async commands: %v", resp)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case got := <-results:
+			if want := fmt.Sprintf("%d\r", i); got != want {
+				t.Fatalf("Async commands should complete in order: got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Async command %d never completed", i)
+		}
+	}
+}
+
+func TestTcp_ControlAsyncQueue(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { io.Copy(io.Discard, conn) }) //never answers
+	defer tc.Close()
+	slow := Command{
+		Name:          "slow",
+		Timeout:       time.Second,
+		Prototype:     "%d\r",
+		CommandRegexp: regexp.MustCompile(`^\d+\r$`),
+		Response:      regexp.MustCompile(`\d+\r`),
+	}
+	tc.SetMaxQueue(2)
+	go tc.Control(slow, 0)
+	time.Sleep(20 * time.Millisecond)
+
+	results := make(chan error, 3)
+	for i := 1; i <= 3; i++ {
+		tc.ControlAsync(slow, func(r Response) { results <- r.Error }, i)
+	}
+	select {
+	case err := <-results:
+		t.Fatalf("Nothing should complete while the command in flight holds the queue: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if n := tc.QueueLen(); n != 2 {
+		t.Fatalf("QueueLen should count queued async commands: %d", n)
+	}
+	if resp := tc.Control(slow, 4); resp.Error != ErrQueueFull {
+		t.Fatalf("Queued async commands should fill the queue: %v", resp)
+	}
+
+	tc.Close()
+	for i, want := range []error{ErrNotConnected, ErrNotConnected, ErrQueueFull} {
+		select {
+		case err := <-results:
+			if err != want {
+				t.Fatalf("Async command %d should fail with %v: %v", i+1, want, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Async command %d was never failed", i+1)
+		}
+	}
+	if n := tc.QueueLen(); n != 0 {
+		t.Fatalf("Queue should be empty once Closed: %d", n)
+	}
+}
+
+func TestTcp_ChannelsPersist(t *testing.T) {
+	tc := New("tcp").(*tcp)
+	sreq, sresp, stop := tc.sreq, tc.sresp, tc.stop
+	if sreq == nil || sresp == nil || stop == nil {
+		t.Fatalf("New should make the runner channels")
+	}
+	for i := 0; i < 3; i++ {
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial #%d failed: %v", i, e)
+		}
+		if tc.sreq != sreq || tc.sresp != sresp || tc.stop != stop {
+			t.Fatalf("Dial #%d should reuse the runner channels", i)
+		}
+		if resp := tc.Control(pingOk); resp.Error != nil {
+			t.Errorf("Control after Dial #%d failed: %v", i, resp)
+		}
+		if e := tc.Close(); e != nil {
+			t.Errorf("Close #%d failed: %v", i, e)
+		}
+	}
+	tc.sreq <- request{Command: pingOk, bytes: []byte("stale\r")} //as if a caller lost a race with Close
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Dial should not trip over a stale request: %v", e)
+	}
+	defer tc.Close()
+	if resp := tc.Control(pingOk); resp.Error != nil {
+		t.Errorf("Control after a stale request failed: %v", resp)
+	}
+}
+
+func TestTcp_ResponseFunc(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //answers "GET n" with a stale reply to n-1 ahead of the one for n
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			seq, _ := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(string(buf[:n]), "GET")))
+			conn.Write([]byte(fmt.Sprintf("REPLY:%d\r", seq-1)))
+			time.Sleep(10 * time.Millisecond)
+			conn.Write([]byte(fmt.Sprintf("REPLY:%d\r", seq)))
+		}
+	})
+	defer tc.Close()
+	get := Command{
+		Name:          "get",
+		Timeout:       200 * time.Millisecond,
+		Prototype:     "GET %d\r",
+		CommandRegexp: regexp.MustCompile(`^GET \d+\r$`),
+		Response:      regexp.MustCompile(`REPLY:\d+\r`),
+	}
+	if resp := tc.Control(get, 42); string(resp.Bytes) != "REPLY:41\r" {
+		t.Fatalf("The static Response should take the first reply: %v", resp)
+	}
+	time.Sleep(20 * time.Millisecond) //let the rest of the reply go by
+	get.ResponseFunc = func(args []interface{}) *regexp.Regexp {
+		return regexp.MustCompile(fmt.Sprintf(`REPLY:%d\r`, args[0]))
+	}
+	for _, seq := range []int{42, 43} {
+		if resp := tc.Control(get, seq); resp.Error != nil || string(resp.Bytes) != fmt.Sprintf("REPLY:%d\r", seq) {
+			t.Errorf("ResponseFunc should only match the reply to %d: %v", seq, resp)
+		}
+	}
+}
+
+func TestTcp_Snapshot(t *testing.T) {
+	if s := new(tcp).Snapshot(); s.Connected || s.State != StateIdle || s.Uptime != 0 {
+		t.Errorf("Snapshot before Dial should be idle and down: %+v", s)
+	}
+	tc := pipeTcp(t, func(conn net.Conn) { //half a reply, then the rest once told
+		buf := make([]byte, 64)
+		conn.Read(buf)
+		conn.Write([]byte("PART"))
+		conn.Read(buf)
+		conn.Write([]byte("-DONE\r"))
+		io.Copy(io.Discard, conn)
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "slow",
+		Timeout:       time.Second,
+		Prototype:     "SLOW\r",
+		CommandRegexp: regexp.MustCompile(`^SLOW\r$`),
+		Response:      regexp.MustCompile(`DONE\r`),
+	}
+	got := make(chan Response)
+	go func() { got <- tc.Control(cmd) }()
+	time.Sleep(20 * time.Millisecond)
+	s := tc.Snapshot()
+	if !s.Connected || s.State != StateWaitingOnReply || s.BufferLen != 4 || s.Uptime <= 0 || s.RemoteAddr == nil {
+		t.Errorf("Snapshot should show the command in flight: %+v", s)
+	}
+	tc.conn.Write([]byte("GO\r")) //straight past the runner, as a nudge for the device
+	if r := <-got; r.Error != nil {
+		t.Fatalf("Slow command failed: %v", r)
+	}
+	b, err := json.Marshal(tc.Snapshot())
+	if err != nil || !strings.Contains(string(b), `"connected":true`) || !strings.Contains(string(b), `"state":"idle"`) {
+		t.Errorf("Snapshot should marshal to JSON: %s %v", b, err)
+	}
+}
+
+func TestTcp_Fallback(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //only speaks the legacy form, and rejects the middle one
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			switch req := string(buf[:n]); {
+			case strings.HasPrefix(req, "get"):
+				conn.Write([]byte("val=" + strings.TrimSpace(req[3:]) + "\r"))
+			case strings.HasPrefix(req, "Q "):
+				conn.Write([]byte("?\r"))
+			}
+		}
+	})
+	defer tc.Close()
+	legacy := Command{
+		Name:          "get",
+		Timeout:       50 * time.Millisecond,
+		Prototype:     "get%d\r",
+		CommandRegexp: regexp.MustCompile(`^get\d+\r$`),
+		Response:      regexp.MustCompile(`val=\d+\r`),
+	}
+	middle := Command{
+		Name:          "query",
+		Timeout:       50 * time.Millisecond,
+		Prototype:     "Q %d\r",
+		CommandRegexp: regexp.MustCompile(`^Q \d+\r$`),
+		Response:      regexp.MustCompile(`OK \d+\r`),
+		Error:         regexp.MustCompile(`\?\r`),
+		Fallback:      &legacy,
+	}
+	modern := Command{
+		Name:          "read",
+		Timeout:       50 * time.Millisecond,
+		Prototype:     "READ:%d\r",
+		CommandRegexp: regexp.MustCompile(`^READ:\d+\r$`),
+		Response:      regexp.MustCompile(`OK \d+\r`),
+		Fallback:      &middle,
+	}
+	if r := tc.Control(modern, 7); r.Error != nil || string(r.Bytes) != "val=7\r" || r.Fallback != 2 {
+		t.Errorf("Control should fall back past a timeout and an error match to the legacy form: %v %d", r, r.Fallback)
+	}
+	if r, ok := tc.TryControl(modern, 9); !ok || r.Error != nil || string(r.Bytes) != "val=9\r" || r.Fallback != 2 {
+		t.Errorf("TryControl should fall back like Control: %v %d %v", r, r.Fallback, ok)
+	}
+	if r := tc.Control(legacy, 8); r.Error != nil || r.Fallback != 0 {
+		t.Errorf("A form that answers should not fall back: %v %d", r, r.Fallback)
+	}
+
+	looped := modern
+	looped.Fallback = &looped //falls back on itself
+	then := time.Now()
+	if r := tc.Control(looped, 9); !errors.Is(r.Error, ErrTimeout) || r.Fallback != MaxFallbackDepth {
+		t.Errorf("A fallback loop should give up after MaxFallbackDepth: %v %d", r, r.Fallback)
+	}
+	if time.Since(then) > time.Duration(MaxFallbackDepth+2)*modern.Timeout {
+		t.Errorf("A fallback loop should not retry forever")
+	}
+}
+
+func TestTcp_CloseGraceful(t *testing.T) {
+	slow := func(conn net.Conn) { //echoes each request after a while
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			conn.Write(buf[:n])
+		}
+	}
+	echo := Command{
+		Name:          "echo",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "%d\r",
+		CommandRegexp: regexp.MustCompile(`^\d+\r$`),
+		Response:      regexp.MustCompile(`\d+\r`),
+	}
+
+	tc := pipeTcp(t, slow)
+	results := make(chan string, 4)
+	for i := 0; i < 4; i++ {
+		tc.ControlAsync(echo, func(r Response) { results <- fmt.Sprintf("%q %v", r.Bytes, r.Error) }, i)
+	}
+	rejected := make(chan Response)
+	go func() {
+		time.Sleep(10 * time.Millisecond) //once the drain is under way
+		rejected <- tc.Control(echo, 99)
+	}()
+	if err := tc.CloseGraceful(time.Second); err != nil {
+		t.Fatalf("CloseGraceful should drain in time: %v", err)
+	}
+	if r := <-rejected; r.Error != ErrClosing {
+		t.Errorf("New commands should be rejected while draining: %v", r)
+	}
+	for i := 0; i < 4; i++ {
+		if got, want := <-results, fmt.Sprintf("\"%d\\r\" <nil>", i); got != want {
+			t.Errorf("Queued command %d should have completed: got %s, want %s", i, got, want)
+		}
+	}
+	if tc.alive.Load() {
+		t.Errorf("CloseGraceful should close once drained")
+	}
+
+	tc = pipeTcp(t, slow)
+	for i := 0; i < 10; i++ {
+		tc.ControlAsync(echo, nil, i)
+	}
+	if err := tc.CloseGraceful(50 * time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("CloseGraceful should give up on a queue that does not drain in time: %v", err)
+	}
+	if tc.alive.Load() {
+		t.Errorf("CloseGraceful should close even if the queue did not drain")
+	}
+}
+
+func TestTcp_CloseGracefulFakeClock(t *testing.T) {
+	fc := &fakeClock{now: time.Unix(0, 0)}
+	tc := &tcp{clock: fc}
+	ticking := make(chan bool)
+	go func() { //poll the socket while dialing, without time passing
+		for {
+			select {
+			case <-ticking:
+				return
+			case <-time.After(time.Millisecond):
+				fc.Advance(0)
+			}
+		}
+	}()
+	if e := tc.Dial(dial, time.Second, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup: %v", e)
+	}
+	close(ticking) //from here on the clock stands still
+
+	tc.ctl.Lock() //a command in flight
+	closed := make(chan error, 1)
+	go func() { closed <- tc.CloseGraceful(time.Hour) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("CloseGraceful should wait on the command in flight: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	tc.unlock()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("CloseGraceful should drain cleanly: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("CloseGraceful should notice the command finishing without the clock moving")
+	}
+
+	tc = &tcp{clock: fc}
+	tc.ctl.Lock() //a command that never finishes
+	defer tc.ctl.Unlock()
+	go func() { closed <- tc.CloseGraceful(time.Hour) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("CloseGraceful should wait until the clock says time is up: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	fc.Advance(time.Hour)
+	select {
+	case err := <-closed:
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("CloseGraceful should time out on the clock: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Advancing the clock past the timeout should end CloseGraceful")
+	}
+}
+
+func TestTcp_MaxResponseBytes(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //floods each request with junk before the reply
+		buf := make([]byte, 64)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+			conn.Write([]byte(strings.Repeat("junk", 256) + "OK\r"))
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:             "status",
+		Timeout:          time.Second,
+		Prototype:        "STATUS\r",
+		CommandRegexp:    regexp.MustCompile("STATUS\r"),
+		Response:         regexp.MustCompile("OK\r"),
+		MaxResponseBytes: 100,
+	}
+	resp := tc.Control(cmd)
+	if resp.Error != ErrResponseTooLarge || string(resp.Bytes) != strings.Repeat("junk", 25) || resp.Duration > 500*time.Millisecond {
+		t.Fatalf("A flood past MaxResponseBytes should fail straight away, truncated: %v", resp)
+	}
+	time.Sleep(10 * time.Millisecond) //let the rest of the flood arrive, to be flushed
+	cmd.MaxResponseBytes = 2000
+	if resp := tc.Control(cmd); resp.Error != nil || string(resp.Bytes) != "OK\r" {
+		t.Fatalf("Replies within MaxResponseBytes should match as usual: %v", resp)
+	}
+}
+
+func TestTcp_ReadWait(t *testing.T) {
+	tc := new(tcp)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+	patient := pingOk
+	patient.ReadWait = time.Second
+	if resp := tc.Control(patient); resp.Error != nil || resp.Duration > 100*time.Millisecond {
+		t.Fatalf("A long ReadWait should still return as soon as the reply arrives: %v", resp)
+	}
+	silent := pingBad.WithTimeout(30 * time.Millisecond)
+	silent.ReadWait = time.Second
+	if resp := tc.Control(silent); resp.Error != ErrTimeout || resp.Duration > 100*time.Millisecond {
+		t.Fatalf("ReadWait should not hold a command past its Timeout: %v", resp)
+	}
+}
+
+func TestTcp_Transcript(t *testing.T) {
+	tc := new(tcp)
+	tc.SetTranscript(1 << 10)
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	defer tc.Close()
+	if got := strings.Count(string(tc.Transcript()), " > 1\n\r\n"); got != 3 {
+		t.Fatalf("Transcript should hold the pings since Dial, got %d:\n%s", got, tc.Transcript())
+	}
+	tc.Control(pingOk)
+	lines := strings.Split(string(tc.Transcript()), "\n")
+	if n := len(lines); n < 4 || !strings.HasSuffix(lines[n-5], " > 1") || !strings.HasSuffix(lines[n-3], " < 1") {
+		t.Fatalf("Transcript should interleave both directions:\n%q", lines)
+	}
+
+	tc.SetTranscript(60)
+	if got := len(tc.Transcript()); got == 0 || got > 60 {
+		t.Fatalf("Transcript should be bounded, got %d bytes", got)
+	}
+	tc.SetTranscript(0)
+	tc.Control(pingOk)
+	if got := tc.Transcript(); len(got) != 0 {
+		t.Fatalf("Turning it off should drop the transcript: %q", got)
+	}
+}
+
+func TestTcp_SetExpectProxyHeader(t *testing.T) {
+	behind := func(header string) *tcp { //a device behind a load balancer, which prepends header
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			server.Write([]byte(header))
+			io.Copy(server, server)
+		}()
+		tc := NewConn(client).(*tcp)
+		tc.SetExpectProxyHeader(true)
+		return tc
+	}
+
+	tc := behind("PROXY TCP4 192.0.2.7 198.51.100.1 56324 443\r\n")
+	if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Dial should consume the header before the ping: %v", e)
+	}
+	if got := tc.RemoteAddr().String(); got != "192.0.2.7:56324" {
+		t.Fatalf("RemoteAddr should come from the header: %v", got)
+	}
+	tc.Close()
+
+	tc = behind("PROXY UNKNOWN\r\n")
+	if e := tc.Dial("pipe", 100*time.Millisecond, pingOk); e != nil || tc.RemoteAddr() == nil {
+		t.Fatalf("PROXY UNKNOWN should fall back to the connection's address: %v", e)
+	}
+	tc.Close()
+
+	for _, bad := range []string{"\r", "PROXY TCP4 192.0.2.7\r\n", "PROXY TCP6 192.0.2.7 198.51.100.1 1 2\r\n", "PROXY TCP4 192.0.2.7 198.51.100.1 99999 2\r\n"} {
+		tc = behind(bad)
+		if e := tc.Dial("pipe", 50*time.Millisecond, pingOk); !errors.Is(e, ErrProxyHeader) || !errors.Is(e, ErrConnectFailed) {
+			t.Errorf("Malformed header %q should fail Dial: %v", bad, e)
+		}
+	}
+}
+
+func TestTcp_SoftTimeout(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //answers the second request late
+		buf := make([]byte, 64)
+		for i := 0; ; i++ {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if i == 1 {
+				time.Sleep(30 * time.Millisecond)
+			}
+			conn.Write(buf[:n])
+		}
+	})
+	defer tc.Close()
+	cmd := pingOk
+	cmd.SoftTimeout = 20 * time.Millisecond
+	if resp := tc.Control(cmd); resp.Error != nil || resp.Slow {
+		t.Fatalf("A prompt reply should not be Slow: %v", resp)
+	}
+	if resp := tc.Control(cmd); resp.Error != nil || !resp.Slow {
+		t.Fatalf("A late reply should succeed, but be Slow: %v", resp)
+	}
+}
+
+func TestTcp_DialWithResult(t *testing.T) {
+	tc := new(tcp)
+	res, e := tc.DialWithResult(dial, 100*time.Millisecond, pingOk)
+	if e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	tc.Close()
+	if res.RemoteAddr == nil || res.RemoteAddr.String() != tc.RemoteAddr().String() || res.Pings != 3 || res.PingRTT <= 0 {
+		t.Fatalf("DialResult not filled in: %+v", res)
+	}
+	res, e = tc.DialWithResult(dial, 100*time.Millisecond, pingBad)
+	if e == nil || res.RemoteAddr == nil || res.Pings != 1 || res.PingRTT != 0 {
+		t.Fatalf("A failed Dial should describe how far it got: %+v %v", res, e)
+	}
+}
+
+func TestTcp_SetPreamble(t *testing.T) {
+	received := make(chan string, 1)
+	tc := pipeTcp(t, func(conn net.Conn) {
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			received <- string(buf[:n])
+			conn.Write([]byte("OK\r"))
+		}
+	})
+	defer tc.Close()
+	cmd := Command{
+		Name:          "status",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "STATUS\r",
+		CommandRegexp: regexp.MustCompile("^STATUS\r$"),
+		Response:      regexp.MustCompile("OK\r"),
+	}
+
+	tc.SetPreamble([]byte{0x1b, 0x1b})
+	if resp := tc.Control(cmd); resp.Error != nil {
+		t.Fatalf("Command should work with a preamble: %v", resp)
+	}
+	if got := <-received; got != "\x1b\x1bSTATUS\r" {
+		t.Fatalf("Preamble should go out just ahead of the command: %q", got)
+	}
+	tc.SetPreamble(nil)
+	tc.Control(cmd)
+	if got := <-received; got != "STATUS\r" {
+		t.Fatalf("Empty preamble should send nothing extra: %q", got)
+	}
+}
+
+func TestTcp_StalledFor(t *testing.T) {
+	tc := pipeTcp(t, func(conn net.Conn) { //trickles a reply in, then goes quiet
+		buf := make([]byte, 64)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		for i := 0; i < 5; i++ {
+			conn.Write([]byte("."))
+			time.Sleep(20 * time.Millisecond)
+		}
+		io.Copy(io.Discard, conn)
+	})
+	defer tc.Close()
+	if d := tc.StalledFor(); d != 0 {
+		t.Fatalf("Nothing in flight should not be stalled: %v", d)
+	}
+	go tc.Control(pingBad.WithTimeout(250 * time.Millisecond))
+	time.Sleep(70 * time.Millisecond)
+	if d := tc.StalledFor(); d <= 0 || d > 30*time.Millisecond {
+		t.Fatalf("Trickling reply should not be stalled for long: %v", d)
+	}
+	time.Sleep(130 * time.Millisecond)
+	if d := tc.StalledFor(); d < 80*time.Millisecond {
+		t.Fatalf("Quiet reply should be stalled: %v", d)
+	}
+	tc.WaitIdle(time.Second)
+	time.Sleep(5 * time.Millisecond)
+	if d := tc.StalledFor(); d != 0 {
+		t.Fatalf("Finished command should not be stalled: %v", d)
+	}
+}
+
+func TestTcp_NoLeaks(t *testing.T) {
+	settled := func(want int) bool { //goroutines on the simulator side wind down in the background
+		for end := time.Now().Add(time.Second); time.Now().Before(end); time.Sleep(5 * time.Millisecond) {
+			if runtime.NumGoroutine() <= want {
+				return true
+			}
+		}
+		return false
+	}
+	before, runs := runtime.NumGoroutine(), Runners()
+
+	tc := new(tcp)
+	if e := tc.Dial("localhost:1", 100*time.Millisecond, pingOk); e == nil {
+		t.Fatalf("Dial to a closed port should fail")
+	}
+	if e := tc.Dial(dial, 50*time.Millisecond, pingBad); e == nil {
+		t.Fatalf("Dial with a failing ping should fail")
+	}
+	if Runners() != runs {
+		t.Fatalf("Failed Dials should leave no runner: %d, was %d", Runners(), runs)
+	}
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Need initial connection to be setup, and couldnt setup")
+	}
+	if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+		t.Fatalf("Redialing should succeed: %v", e)
+	}
+	if Runners() != runs+1 {
+		t.Fatalf("Redialing should replace the runner, not add one: %d, was %d", Runners(), runs)
+	}
+	tc.Close()
+	if Runners() != runs {
+		t.Fatalf("Close should reap the runner: %d, was %d", Runners(), runs)
+	}
+	if !settled(before) {
+		t.Fatalf("Goroutines leaked: %d, was %d", runtime.NumGoroutine(), before)
+	}
+}
+
+func TestTcp_SetWarmup(t *testing.T) {
+	width := Command{
+		Name:          "width",
+		Timeout:       100 * time.Millisecond,
+		Prototype:     "TERM WIDTH 0\r",
+		CommandRegexp: regexp.MustCompile("TERM WIDTH 0\r"),
+		Response:      regexp.MustCompile("TERM WIDTH 0\r"), //simulator echos
+	}
+	paging := width.WithPrototype("TERM PAGING OFF\r")
+	paging.Name, paging.CommandRegexp, paging.Response = "paging", regexp.MustCompile(".*"), regexp.MustCompile("PAGING OFF\r")
+
+	client, server := net.Pipe()
+	var mu sync.Mutex
+	var got []string
+	go func() { //echo, noting what came in
+		buf := make([]byte, 64)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			got = append(got, string(buf[:n]))
+			mu.Unlock()
+			server.Write(buf[:n])
+		}
+	}()
+	tc := NewConn(client).(*tcp)
+	tc.SetWarmup([]Command{width, paging})
+	tc.SetOnConnect(func(a Arbiter) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if want := "\r,\r,\r,TERM WIDTH 0\r,TERM PAGING OFF\r"; strings.Join(got, ",") != want {
+			return fmt.Errorf("Warmup should follow the pings, before OnConnect: %q", got)
+		}
+		return nil
+	})
+	if e := tc.Dial("pipe", time.Second, pingOk); e != nil {
+		t.Fatalf("Dial with working warmup should succeed: %v", e)
+	}
+	tc.Close()
+
+	bad := width
+	bad.Name, bad.Response = "bad", regexp.MustCompile("a^")
+	tc = new(tcp)
+	tc.SetWarmup([]Command{width, bad})
+	e := tc.Dial(dial, time.Second, pingOk)
+	if !errors.Is(e, ErrSetupFailed) || !errors.Is(e, ErrTimeout) || !strings.Contains(e.Error(), `"bad"`) {
+		t.Fatalf("Failing warmup should fail Dial with ErrSetupFailed naming the command: %v", e)
+	}
+	if resp := tc.Control(pingOk); resp.Error != ErrNotConnected {
+		t.Fatalf("Connection should be torn down after failed warmup: %v", resp)
+	}
+}
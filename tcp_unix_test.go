@@ -0,0 +1,68 @@
+//go:build unix
+
+package arbiter
+
+/*
+The MIT License (MIT)
+
+Copyright (c) 2016 Nick Potts
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+//noDelay reads TCP_NODELAY straight off the socket under conn
+func noDelay(t *testing.T, conn net.Conn) bool {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		t.Fatalf("Expected a *net.TCPConn, got %T", conn)
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		t.Fatalf("Unable to get at the socket: %v", err)
+	}
+	var v int
+	if err := raw.Control(func(fd uintptr) { v, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY) }); err != nil {
+		t.Fatalf("Unable to get at the socket: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("Unable to read TCP_NODELAY: %v", err)
+	}
+	return v != 0
+}
+
+func TestTcp_SetNoDelaySocket(t *testing.T) {
+	for _, want := range []bool{true, false} {
+		tc := new(tcp)
+		tc.SetNoDelay(want)
+		if e := tc.Dial(dial, 100*time.Millisecond, pingOk); e != nil {
+			t.Fatalf("Dial should succeed with SetNoDelay(%v): %v", want, e)
+		}
+		if got := noDelay(t, tc.conn); got != want {
+			t.Errorf("SetNoDelay(%v) left TCP_NODELAY %v on the socket", want, got)
+		}
+		tc.Close()
+	}
+}